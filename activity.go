@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -20,17 +19,7 @@ import (
 // }
 
 func logActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	if len(tokenString) < 8 {
-		sendErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
-		log.Println("Authorization token is missing or invalid.")
-		return
-	}
-
-	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	claims, err := requestClaims(r)
 	if err != nil {
 		sendErrorResponse(w, http.StatusUnauthorized, "Invalid token")
 		log.Println("Invalid token:", err)
@@ -46,6 +35,7 @@ func logActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	activity.Username = claims.Username
 	activity.Timestamp = time.Now()
+	activity.IPAddress = clientIP(r)
 
 	activitiesCollection := client.Database("your_database").Collection("activities")
 	_, err = activitiesCollection.InsertOne(context.TODO(), activity)
@@ -63,16 +53,7 @@ func logActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 // Fetch activity feed
 func getActivityFeed(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	if len(tokenString) < 8 {
-		sendErrorResponse(w, http.StatusUnauthorized, "Unauthorized")
-		return
-	}
-
-	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	claims, err := requestClaims(r)
 	if err != nil {
 		sendErrorResponse(w, http.StatusUnauthorized, "Invalid token")
 		return
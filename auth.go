@@ -6,9 +6,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -21,31 +25,57 @@ import (
 const (
 	refreshTokenTTL = 7 * 24 * time.Hour // 7 days
 	accessTokenTTL  = 15 * time.Minute   // 15 minutes
-)
 
-var (
-	// tokenSigningAlgo = jwt.SigningMethodHS256
-	jwtSecret = []byte("your_secret_key") // Replace with a secure secret key
+	maxPrevRefreshTokens = 20 // rotated-out refresh tokens remembered for reuse detection
 )
 
 // JWT claims
 type Claims struct {
-	Username string `json:"username"`
-	UserID   string `json:"userId"`
+	Username  string `json:"username"`
+	UserID    string `json:"userId"`
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"` // informational, authorization reads the role from the database
 	jwt.RegisteredClaims
 }
 
+// credentials is what login and register read. User never decodes a password from JSON,
+// so it can't be sent back by accident.
+type credentials struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var user User
+	var user credentials
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if user.Password == "" || (user.Username == "" && user.Email == "") {
+		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
 	fmt.Println("Login : JSON decode")
-	// Look for the user in MongoDB by username
+
+	// Accounts can sign in with their username or, as business owners are used to, their email
+	identifier, filter := user.Username, bson.M{"username": user.Username}
+	if identifier == "" && user.Email != "" {
+		identifier, filter = user.Email, bson.M{"email": user.Email}
+	}
+
+	ip := clientIP(r)
+	if wait := loginRetryAfter(identifier, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+0.5)))
+		http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// Look for the user in MongoDB
 	var storedUser User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": user.Username}).Decode(&storedUser)
+	err := userCollection.FindOne(context.TODO(), filter).Decode(&storedUser)
 	if err != nil {
+		recordLoginFailure(identifier, ip)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
@@ -53,41 +83,28 @@ func login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password)); err != nil {
+		recordLoginFailure(identifier, ip)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 	fmt.Println("Login : Bcrypt")
 
-	// Create JWT claims
-	claims := &Claims{
-		Username: storedUser.Username,
-		UserID:   storedUser.UserID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
-		},
-	}
-	tokenString, err := createToken(claims)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
-	}
-	fmt.Println("Login : tokenString")
-
-	refreshToken, err := generateRefreshToken()
-	if err != nil {
-		http.Error(w, "Error generating refresh token", http.StatusInternalServerError)
+	// With 2FA on, the password only buys a challenge for the second step, and failures
+	// are only cleared once that passes too
+	if storedUser.TOTPEnabled {
+		challenge, err := createLoginChallenge(storedUser.UserID, identifier)
+		if err != nil {
+			http.Error(w, "Failed to start two-factor login", http.StatusInternalServerError)
+			return
+		}
+		sendResponse(w, http.StatusOK, map[string]interface{}{"twoFactorRequired": true, "challenge": challenge}, "Two-factor authentication required", nil)
 		return
 	}
-	fmt.Println("Login : refreshToken")
+	clearLoginFailures(identifier)
 
-	hashedRefreshToken := hashToken(refreshToken)
-	_, err = userCollection.UpdateOne(
-		context.TODO(),
-		bson.M{"userid": storedUser.UserID},
-		bson.M{"$set": bson.M{"refresh_token": hashedRefreshToken, "refresh_expiry": time.Now().Add(refreshTokenTTL)}},
-	)
+	tokenString, refreshToken, err := issueTokens(storedUser, r)
 	if err != nil {
-		http.Error(w, "Error storing refresh token", http.StatusInternalServerError)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 	fmt.Println("Login : beforeSendResponse")
@@ -96,16 +113,32 @@ func login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 }
 
 func register(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	registerWithRole(w, r, roleUser)
+}
+
+// registerWithRole creates an account with the given role, which is never taken from the request body
+func registerWithRole(w http.ResponseWriter, r *http.Request, role string) {
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	if creds.Username == "" || creds.Password == "" {
+		http.Error(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
+	user := User{Username: creds.Username, Email: creds.Email}
 	log.Printf("Registering user: %s", user.Username)
 
+	addr, err := mail.ParseAddress(user.Email)
+	if err != nil || addr.Address != user.Email {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
 	// Check if user exists in database
 	var existingUser User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": user.Username}).Decode(&existingUser)
+	err = userCollection.FindOne(context.TODO(), bson.M{"username": user.Username}).Decode(&existingUser)
 	if err == nil {
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
@@ -114,7 +147,16 @@ func register(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	err = userCollection.FindOne(context.TODO(), bson.M{"email": user.Email}).Decode(&existingUser)
+	if err == nil {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	} else if err != mongo.ErrNoDocuments {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 		return
@@ -122,6 +164,9 @@ func register(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	user.Password = string(hashedPassword)
 	user.UserID = "u" + GenerateName(10)
+	user.Role = role
+	user.IsVerified = false
+	user.CreatedAt = time.Now()
 
 	_, err = userCollection.InsertOne(context.TODO(), user)
 	if err != nil {
@@ -129,6 +174,11 @@ func register(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
+	// The account is usable without it, so a failed mail only gets logged; the user can ask for a resend
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Error sending verification email to %s: %v", user.Username, err)
+	}
+
 	sendResponse(w, http.StatusCreated, map[string]string{"username": user.Username}, "User registered successfully", nil)
 }
 
@@ -179,17 +229,25 @@ func logoutUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	// Extract the token and invalidate it in Redis
-	tokenString = tokenString[7:]
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := parseClaims(tokenString[7:])
+	if err != nil {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
+	if err := revokeToken(claims); err != nil {
+		log.Printf("Error revoking token: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	if claims.SessionID != "" {
+		if err := revokeSession(claims.SessionID); err != nil {
+			log.Printf("Error revoking session %s: %v", claims.SessionID, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Remove token from Redis cache
 	_, err = RdxHdel("tokki", claims.UserID)
 	if err != nil {
@@ -201,53 +259,147 @@ func logoutUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	sendResponse(w, http.StatusOK, nil, "User logged out successfully", nil)
 }
 
+// refreshToken exchanges an opaque refresh token for a new access/refresh pair.
+// The presented token is rotated out; presenting it again revokes every session of the user.
 func refreshToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Missing refresh token", http.StatusBadRequest)
+		return
+	}
+	hashed := hashToken(body.RefreshToken)
+
+	var session Session
+	err := sessionCollection().FindOne(context.TODO(), bson.M{"refresh_token": hashed}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		// A rotated-out token is being replayed: assume it was stolen and sign the user out everywhere
+		var reused Session
+		if sessionCollection().FindOne(context.TODO(), bson.M{"prev_refresh_tokens": hashed}).Decode(&reused) == nil {
+			log.Printf("Refresh token reuse detected for user %s, revoking all sessions", reused.UserID)
+			if err := revokeUserSessions(reused.UserID); err != nil {
+				log.Printf("Error revoking sessions for user %s: %v", reused.UserID, err)
+			}
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	if len(tokenString) < 7 || tokenString[:7] != "Bearer " {
-		http.Error(w, "Invalid token format", http.StatusUnauthorized)
+	if time.Now().After(session.RefreshExpiry) {
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
 		return
 	}
 
-	tokenString = tokenString[7:]
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	var storedUser User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": session.UserID}).Decode(&storedUser); err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
 
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	tokenString, newRefreshToken, err := rotateTokens(storedUser, session, hashed, r)
+	if err == errRefreshTokenUsed {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure the token is not expired and refresh it
-	if time.Until(claims.ExpiresAt.Time) < 30*time.Minute {
-		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(72 * time.Hour)) // Extend the expiration
-		newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		newTokenString, err := newToken.SignedString(jwtSecret)
-		if err != nil {
-			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
-			return
-		}
+	sendResponse(w, http.StatusOK, map[string]string{"token": tokenString, "refreshToken": newRefreshToken, "userid": storedUser.UserID}, "Token refreshed successfully", nil)
+}
 
-		// Update the token in Redis
-		err = RdxHset("tokki", claims.UserID, newTokenString)
-		if err != nil {
-			log.Printf("Error updating token in Redis: %v", err)
-		}
+// issueTokens starts a new session for the user and signs an access token bound to it
+func issueTokens(user User, r *http.Request) (string, string, error) {
+	session, refreshToken, err := newSession(user.UserID, r)
+	if err != nil {
+		return "", "", err
+	}
 
-		sendResponse(w, http.StatusOK, map[string]string{"token": newTokenString}, "Token refreshed successfully", nil)
-	} else {
-		http.Error(w, "Token refresh not allowed yet", http.StatusForbidden)
+	tokenString, err := createToken(newClaims(user, session.SessionID))
+	if err != nil {
+		return "", "", err
 	}
+
+	// Every completed login ends up here
+	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": user.UserID}, bson.M{"$set": bson.M{"last_login": time.Now()}})
+	if err != nil {
+		log.Printf("Error recording last login for user %s: %v", user.UserID, err)
+	}
+	return tokenString, refreshToken, nil
 }
 
-// Generates a random refresh token
-func generateRefreshToken() (string, error) {
+var errRefreshTokenUsed = errors.New("refresh token already used")
+
+// rotateTokens replaces the session's refresh token identified by oldHash and remembers the old hash for reuse detection
+func rotateTokens(user User, session Session, oldHash string, r *http.Request) (string, string, error) {
+	tokenString, err := createToken(newClaims(user, session.SessionID))
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := generateSecureToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	// Matching on the old hash makes the swap atomic, so two concurrent refreshes can't both succeed
+	result, err := sessionCollection().UpdateOne(
+		context.TODO(),
+		bson.M{"sessionid": session.SessionID, "refresh_token": oldHash},
+		bson.M{
+			"$set": bson.M{
+				"refresh_token":  hashToken(refreshToken),
+				"refresh_expiry": time.Now().Add(refreshTokenTTL),
+				"last_seen":      time.Now(),
+				"ip":             clientIP(r),
+			},
+			"$push": bson.M{"prev_refresh_tokens": bson.M{
+				"$each":  bson.A{oldHash},
+				"$slice": -maxPrevRefreshTokens,
+			}},
+		},
+	)
+	if err != nil {
+		return "", "", err
+	}
+	if result.MatchedCount == 0 {
+		return "", "", errRefreshTokenUsed
+	}
+	return tokenString, refreshToken, nil
+}
+
+// revokeUserSessions ends every session of the user and invalidates every access token issued so far
+func revokeUserSessions(userID string) error {
+	if err := revokeAllTokens(userID); err != nil {
+		return err
+	}
+	if _, err := sessionCollection().DeleteMany(context.TODO(), bson.M{"userid": userID}); err != nil {
+		return err
+	}
+	if _, err := RdxHdel("tokki", userID); err != nil {
+		log.Printf("Error removing token from Redis: %v", err)
+	}
+	return nil
+}
+
+func newClaims(user User, sessionID string) *Claims {
+	return &Claims{
+		Username:  user.Username,
+		UserID:    user.UserID,
+		SessionID: sessionID,
+		Role:      user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+		},
+	}
+}
+
+// Generates a random opaque token (refresh, verification, ...)
+func generateSecureToken() (string, error) {
 	tokenBytes := make([]byte, 32)
 	_, err := rand.Read(tokenBytes)
 	if err != nil {
@@ -256,6 +408,16 @@ func generateRefreshToken() (string, error) {
 	return hex.EncodeToString(tokenBytes), nil
 }
 
+// Generates a random token ID for the jti claim
+func generateTokenID() (string, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
 // Hashes a given token
 func hashToken(token string) string {
 	hash := sha256.New()
@@ -265,24 +427,46 @@ func hashToken(token string) string {
 
 func authenticate(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if claims, ok, err := gatewayClaims(r); ok {
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			next(w, r.WithContext(withClaims(r.Context(), claims)), ps)
+			return
+		}
+
 		tokenString, err := extractToken(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		if strings.HasPrefix(tokenString, patPrefix) {
+			authenticatePAT(w, r, ps, tokenString, next)
+			return
+		}
 
-		if err != nil || !token.Valid {
+		claims, err := parseClaims(tokenString)
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), userIDKey, claims.UserID)
-		next(w, r.WithContext(ctx), ps)
+		next(w, r.WithContext(withClaims(r.Context(), claims)), ps)
+	}
+}
+
+// authenticateOptional lets anonymous requests through as they are and authenticates the ones
+// carrying credentials, so a bad or underscoped token is refused rather than ignored
+func authenticateOptional(next httprouter.Handle) httprouter.Handle {
+	authenticated := authenticate(next)
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if r.Header.Get("Authorization") == "" && r.Header.Get("X-Auth-Signature") == "" {
+			next(w, r, ps)
+			return
+		}
+		authenticated(w, r, ps)
 	}
 }
 
@@ -299,7 +483,37 @@ func extractToken(r *http.Request) (string, error) {
 	return tokenString[7:], nil
 }
 
+// parseClaims verifies the signature of an access token and checks it against the deny-list
+func parseClaims(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, jwtKeys.keyFunc, jwt.WithValidMethods(jwtKeys.algorithms()))
+	if err != nil || !token.Valid {
+		return nil, errInvalidToken
+	}
+
+	if isTokenRevoked(claims) {
+		return nil, errTokenRevoked
+	}
+	return claims, nil
+}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errTokenRevoked = errors.New("token has been revoked")
+)
+
 func createToken(claims *Claims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	// Every token carries a jti so it can be revoked individually
+	if claims.ID == "" {
+		jti, err := generateTokenID()
+		if err != nil {
+			return "", err
+		}
+		claims.ID = jti
+	}
+	if claims.IssuedAt == nil {
+		claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	}
+
+	return jwtKeys.sign(claims)
 }
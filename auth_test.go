@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useMockUsers points userCollection at the mock deployment of mt
+func useMockUsers(mt *mtest.T) {
+	prev := userCollection
+	userCollection = mt.Coll
+	mt.Cleanup(func() { userCollection = prev })
+}
+
+// storedUserResponse is what FindOne gets back for an account with the given password
+func storedUserResponse(t testing.TB, mt *mtest.T, username, password string) bson.D {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mtest.CreateCursorResponse(0, mt.Coll.Database().Name()+"."+mt.Coll.Name(), mtest.FirstBatch, bson.D{
+		{Key: "userid", Value: "u1"},
+		{Key: "username", Value: username},
+		{Key: "password", Value: string(hash)},
+	})
+}
+
+func postLogin(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	login(rec, r, nil)
+	return rec
+}
+
+func TestLoginRejectsWrongPassword(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("wrong password", func(mt *mtest.T) {
+		useMockUsers(mt)
+		mt.AddMockResponses(storedUserResponse(t, mt, "alice", "correct horse"))
+		if rec := postLogin(`{"username":"alice","password":"battery staple"}`); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d %q, want 401", rec.Code, rec.Body.String())
+		}
+	})
+
+	mt.Run("unknown user", func(mt *mtest.T) {
+		useMockUsers(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.Coll.Database().Name()+"."+mt.Coll.Name(), mtest.FirstBatch))
+		if rec := postLogin(`{"username":"nobody","password":"battery staple"}`); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("got %d %q, want 401", rec.Code, rec.Body.String())
+		}
+	})
+
+	mt.Run("empty password", func(mt *mtest.T) {
+		useMockUsers(mt)
+		for _, body := range []string{`{"username":"alice","password":""}`, `{"username":"alice"}`, `{"password":"x"}`} {
+			if rec := postLogin(body); rec.Code != http.StatusBadRequest {
+				t.Fatalf("%s: got %d %q, want 400", body, rec.Code, rec.Body.String())
+			}
+		}
+	})
+}
+
+func TestRegisterRequiresPassword(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("missing password", func(mt *mtest.T) {
+		useMockUsers(mt)
+		for _, body := range []string{`{"username":"bob","email":"bob@example.com"}`, `{"username":"bob","email":"bob@example.com","password":""}`} {
+			rec := httptest.NewRecorder()
+			registerWithRole(rec, httptest.NewRequest("POST", "/owner/register", strings.NewReader(body)), roleOwner)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("%s: got %d %q, want 400", body, rec.Code, rec.Body.String())
+			}
+		}
+	})
+
+	mt.Run("password is hashed", func(mt *mtest.T) {
+		useMockUsers(mt)
+		ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch), // no such username
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch), // no such email
+			mtest.CreateSuccessResponse(),                       // insert
+		)
+		rec := httptest.NewRecorder()
+		body := `{"username":"bob","email":"bob@example.com","password":"correct horse"}`
+		registerWithRole(rec, httptest.NewRequest("POST", "/owner/register", strings.NewReader(body)), roleOwner)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("got %d %q, want 201", rec.Code, rec.Body.String())
+		}
+
+		insert := mt.GetStartedEvent()
+		for insert != nil && insert.CommandName != "insert" {
+			insert = mt.GetStartedEvent()
+		}
+		if insert == nil {
+			t.Fatal("nothing was inserted")
+		}
+		var doc struct {
+			Password string `bson:"password"`
+			Role     string `bson:"role"`
+		}
+		if err := bson.Unmarshal(insert.Command.Lookup("documents", "0").Document(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Role != roleOwner {
+			t.Fatalf("stored role %q", doc.Role)
+		}
+		if bcrypt.CompareHashAndPassword([]byte(doc.Password), []byte("correct horse")) != nil {
+			t.Fatal("stored hash isn't of the submitted password")
+		}
+		if bcrypt.CompareHashAndPassword([]byte(doc.Password), []byte("")) == nil {
+			t.Fatal("stored hash is of the empty password")
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Roles in increasing order of privilege. Accounts without a role are plain users.
+// Organizers and business owners sit side by side: neither includes the other.
+// The first admin has to be set directly in the database.
+const (
+	roleUser      = "user"
+	roleOrganizer = "organizer"
+	roleOwner     = "owner"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+var roleRank = map[string]int{
+	roleUser:      1,
+	roleOrganizer: 2,
+	roleOwner:     2,
+	roleModerator: 3,
+	roleAdmin:     4,
+}
+
+const roleKey contextKey = "role"
+
+// hasRole reports whether role grants at least the privileges of required
+func hasRole(role, required string) bool {
+	if role == "" {
+		role = roleUser
+	}
+	if roleRank[role] == roleRank[required] {
+		return role == required
+	}
+	return roleRank[role] > roleRank[required]
+}
+
+// userRole looks the role up on every request so role changes apply without a new token
+func userRole(userID string) (string, error) {
+	var user struct {
+		Role string `bson:"role"`
+	}
+	err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user)
+	if err != nil {
+		return "", err
+	}
+	if user.Role == "" {
+		return roleUser, nil
+	}
+	return user.Role, nil
+}
+
+// withRole adds the caller's role to the context. It must run inside authenticate.
+func withRole(w http.ResponseWriter, r *http.Request) (*http.Request, string, bool) {
+	if role, ok := r.Context().Value(roleKey).(string); ok {
+		return r, role, true
+	}
+
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return r, "", false
+	}
+	role, err := userRole(userID)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return r, "", false
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return r, "", false
+	}
+	return r.WithContext(context.WithValue(r.Context(), roleKey, role)), role, true
+}
+
+// requireRole only lets callers with at least the given role through
+func requireRole(required string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r, role, ok := withRole(w, r)
+		if !ok {
+			return
+		}
+		if !hasRole(role, required) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// ownerLookup returns the IDs of the users owning the resource addressed by the route
+type ownerLookup func(ps httprouter.Params) ([]string, error)
+
+// requireOwner lets the owner of the resource through, as well as anyone holding the override role
+func requireOwner(lookup ownerLookup, override string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r, role, ok := withRole(w, r)
+		if !ok {
+			return
+		}
+		if hasRole(role, override) {
+			next(w, r, ps)
+			return
+		}
+
+		owners, err := lookup(ps)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error looking up resource owner for %s: %v", r.URL.Path, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		userID, _ := r.Context().Value(userIDKey).(string)
+		if !isOwner(owners, userID) {
+			log.Printf("User %s denied access to %s %s", userID, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+func isOwner(owners []string, userID string) bool {
+	for _, owner := range owners {
+		if owner != "" && owner == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func eventOwner(ps httprouter.Params) ([]string, error) {
+	var event struct {
+		CreatorID string `bson:"creatorid"`
+	}
+	err := client.Database("eventdb").Collection("events").FindOne(context.TODO(), bson.M{"eventid": ps.ByName("eventid")}).Decode(&event)
+	return []string{event.CreatorID}, err
+}
+
+func placeOwner(ps httprouter.Params) ([]string, error) {
+	var place struct {
+		CreatedBy string `bson:"createdBy"`
+	}
+	err := client.Database("eventdb").Collection("places").FindOne(context.TODO(), bson.M{"placeid": ps.ByName("placeid")}).Decode(&place)
+	return []string{place.CreatedBy}, err
+}
+
+// entityOwner owns the event or place addressed by :entitytype and :entityid
+func entityOwner(ps httprouter.Params) ([]string, error) {
+	id := ps.ByName("entityid")
+	switch ps.ByName("entitytype") {
+	case "event":
+		return eventOwner(httprouter.Params{{Key: "eventid", Value: id}})
+	case "place":
+		return placeOwner(httprouter.Params{{Key: "placeid", Value: id}})
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func mediaOwner(ps httprouter.Params) ([]string, error) {
+	var media struct {
+		CreatorID string `bson:"creatorid"`
+	}
+	filter := bson.M{"entityid": ps.ByName("entityid"), "entitytype": ps.ByName("entitytype"), "id": ps.ByName("id")}
+	err := client.Database("eventdb").Collection("media").FindOne(context.TODO(), filter).Decode(&media)
+	return []string{media.CreatorID}, err
+}
+
+func postOwner(ps httprouter.Params) ([]string, error) {
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	var post struct {
+		UserID string `bson:"userid"`
+	}
+	err = client.Database("twitterClone").Collection("posts").FindOne(context.TODO(), bson.M{"_id": id}).Decode(&post)
+	return []string{post.UserID}, err
+}
+
+func businessOwners(ps httprouter.Params) ([]string, error) {
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	var business struct {
+		Owners []string `bson:"owners"`
+	}
+	err = client.Database("places_db").Collection("businesses").FindOne(context.TODO(), bson.M{"_id": id}).Decode(&business)
+	return business.Owners, err
+}
+
+// setUserRole lets admins promote or demote accounts
+func setUserRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, ok := roleRank[body.Role]; !ok {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	result, err := userCollection.UpdateOne(context.TODO(), bson.M{"userid": ps.ByName("userid")}, bson.M{"$set": bson.M{"role": body.Role}})
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	invalidate(r.Context(), userTag(ps.ByName("userid")))
+
+	sendResponse(w, http.StatusOK, map[string]string{"userid": ps.ByName("userid"), "role": body.Role}, "Role updated", nil)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMediaUploadNeedsTheEntityOwner(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	tests := []struct {
+		name       string
+		entityType string
+		role       string
+		creator    string
+		want       int
+	}{
+		{"event owner", "event", roleOrganizer, "u1", http.StatusOK},
+		{"someone else's event", "event", roleUser, "u2", http.StatusForbidden},
+		{"someone else's place", "place", roleUser, "u2", http.StatusForbidden},
+		{"admin", "place", roleAdmin, "", http.StatusOK},
+		{"unknown entity type", "post", roleUser, "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockUsers(mt)
+			prev := client
+			client = mt.Client
+			mt.Cleanup(func() { client = prev })
+
+			ns := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "role", Value: tt.role}}))
+			if tt.creator != "" {
+				owner := "creatorid"
+				if tt.entityType == "place" {
+					owner = "createdBy"
+				}
+				mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: owner, Value: tt.creator}}))
+			}
+
+			reached := false
+			handler := requireOwner(entityOwner, roleAdmin, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+				reached = true
+			})
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/media/"+tt.entityType+"/x1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), userIDKey, "u1"))
+			handler(rec, r, httprouter.Params{{Key: "entitytype", Value: tt.entityType}, {Key: "entityid", Value: "x1"}})
+
+			if rec.Code != tt.want || reached != (tt.want == http.StatusOK) {
+				t.Fatalf("got %d %q, reached the handler: %v, want %d", rec.Code, rec.Body.String(), reached, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerchEntity(t *testing.T) {
+	if kind, id := merchEntity(httprouter.Params{{Key: "placeid", Value: "p1"}, {Key: "merchid", Value: "m1"}}); kind != "place" || id != "p1" {
+		t.Fatalf("place route gave %s %s", kind, id)
+	}
+	if kind, id := merchEntity(httprouter.Params{{Key: "eventid", Value: "e1"}}); kind != "event" || id != "e1" {
+		t.Fatalf("event route gave %s %s", kind, id)
+	}
+	if filter := merchItemFilter("place", "p1", "m1"); filter["eventid"] != "p1" || filter["entity_type"] != "place" || filter["merchid"] != "m1" {
+		t.Fatalf("place merch filter is %v", filter)
+	}
+}
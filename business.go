@@ -211,59 +211,52 @@ func GetPromotionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.
 	json.NewEncoder(w).Encode(promotions)
 }
 
+// RegisterOwnerHandler creates a regular account with the owner role. Owners log in
+// through /api/login (or /owner/login) like everyone else.
 func RegisterOwnerHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var owner Owner
-	if err := json.NewDecoder(r.Body).Decode(&owner); err != nil {
-		http.Error(w, "Invalid input", http.StatusBadRequest)
-		return
-	}
-
-	collection := client.Database("places_db").Collection("owners")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	result, err := collection.InsertOne(ctx, owner)
-	if err != nil {
-		http.Error(w, "Failed to register owner", http.StatusInternalServerError)
-		return
-	}
-
-	owner.ID = result.InsertedID.(primitive.ObjectID)
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(owner)
+	registerWithRole(w, r, roleOwner)
 }
 
-func LoginOwnerHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var credentials struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		http.Error(w, "Invalid input", http.StatusBadRequest)
+// GetOwnedBusinessesHandler lists the businesses of the logged in owner
+func GetOwnedBusinessesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	collection := client.Database("places_db").Collection("owners")
+	collection := client.Database("places_db").Collection("businesses")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var owner Owner
-	err := collection.FindOne(ctx, bson.M{"email": credentials.Email, "password": credentials.Password}).Decode(&owner)
+	cursor, err := collection.Find(ctx, bson.M{"owners": userID})
 	if err != nil {
-		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		http.Error(w, "Failed to fetch businesses", http.StatusInternalServerError)
+		return
+	}
+	businesses := []Business{}
+	if err := cursor.All(ctx, &businesses); err != nil {
+		http.Error(w, "Failed to parse businesses", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(owner)
+	json.NewEncoder(w).Encode(businesses)
 }
 
 func AddBusinessByOwnerHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	var business Business
 	if err := json.NewDecoder(r.Body).Decode(&business); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	business.Owners = []string{userID}
 
 	collection := client.Database("places_db").Collection("businesses")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -292,6 +285,13 @@ func UpdateBusinessHandler(w http.ResponseWriter, r *http.Request, ps httprouter
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	// Ownership can't be changed through a plain update
+	delete(update, "_id")
+	delete(update, "owners")
+	if len(update) == 0 {
+		http.Error(w, "No fields to update", http.StatusBadRequest)
+		return
+	}
 
 	collection := client.Database("places_db").Collection("businesses")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// Handlers cache through appCache instead of talking to Redis. Every entry belongs to a
+// cacheNamespace, which sets its TTL and version; keys look like cache:<name>:v<version>:<id>,
+// so bumping a version when a cached type changes shape leaves the old entries to expire.
+// CACHE_BACKEND=memory keeps everything in process, for tests and running without Redis.
+//
+// Entries are tagged with what they were built from (eventTag, placeTag, userTag). Write paths
+// call invalidate with the tags of whatever they changed instead of knowing every key. Every
+// invalidation also bumps a generation per tag; cached reads the generations before it loads
+// and only stores the result if none moved, so a load racing a write can't put back what the
+// write just dropped.
+
+type Cache interface {
+	// Get returns ok false on a miss
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error
+	Del(ctx context.Context, keys ...string) error
+	// SetIfCurrent is Set, unless a tag's generation is no longer the one in gens.
+	// stored is false when it skipped the write.
+	SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string, gens []int64) (stored bool, err error)
+	// Generations returns the generation of each tag, which every Invalidate of it bumps
+	Generations(ctx context.Context, tags ...string) ([]int64, error)
+	// Invalidate removes every entry stored with any of the tags
+	Invalidate(ctx context.Context, tags ...string) error
+}
+
+// tagTTL bounds how long a tag remembers its keys, longer than any namespace TTL
+const tagTTL = 24 * time.Hour
+
+var errNoTTL = errors.New("cache entries need a ttl")
+
+var (
+	appCache    Cache = newMemoryCache()
+	cacheFlight singleflight.Group
+)
+
+// newCacheFromEnv picks the backend, Redis unless CACHE_BACKEND says otherwise
+func newCacheFromEnv() Cache {
+	if os.Getenv("CACHE_BACKEND") == "memory" {
+		return newMemoryCache()
+	}
+	return &redisCache{client: conn}
+}
+
+type redisCache struct {
+	client *redis.Client
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error while doing GET command in redis : %v", err)
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	if ttl <= 0 {
+		return errNoTTL
+	}
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, value, ttl)
+		for _, tag := range tags {
+			pipe.SAdd(ctx, tagKey(tag), key)
+			pipe.Expire(ctx, tagKey(tag), tagTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while doing SET command in redis : %v", err)
+	}
+	return nil
+}
+
+// setIfCurrentScript takes KEYS key, then the tag and generation key of every tag, and ARGV
+// value, ttl, tag ttl (both ms), then the generation seen for every tag
+var setIfCurrentScript = redis.NewScript(`
+local n = (#KEYS - 1) / 2
+for i = 1, n do
+	if tonumber(redis.call('GET', KEYS[2 * i + 1]) or '0') ~= tonumber(ARGV[3 + i]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+for i = 1, n do
+	redis.call('SADD', KEYS[2 * i], KEYS[1])
+	redis.call('PEXPIRE', KEYS[2 * i], ARGV[3])
+end
+return 1
+`)
+
+func (c *redisCache) SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, tags []string, gens []int64) (bool, error) {
+	if ttl <= 0 {
+		return false, errNoTTL
+	}
+	if len(gens) != len(tags) {
+		return false, fmt.Errorf("%d generations for %d tags", len(gens), len(tags))
+	}
+	keys := []string{key}
+	args := []interface{}{value, ttl.Milliseconds(), tagTTL.Milliseconds()}
+	for i, tag := range tags {
+		keys = append(keys, tagKey(tag), genKey(tag))
+		args = append(args, gens[i])
+	}
+	stored, err := setIfCurrentScript.Run(ctx, c.client, keys, args...).Int()
+	if err != nil {
+		return false, fmt.Errorf("error while doing SET command in redis : %v", err)
+	}
+	return stored == 1, nil
+}
+
+func (c *redisCache) Generations(ctx context.Context, tags ...string) ([]int64, error) {
+	gens := make([]int64, len(tags))
+	if len(tags) == 0 {
+		return gens, nil
+	}
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = genKey(tag)
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error while doing MGET command in redis : %v", err)
+	}
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			gens[i], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return gens, nil
+}
+
+// invalidateScript takes the tag and generation key of every tag as KEYS and the tag ttl (ms)
+// as ARGV. Running the sweep as one script means no key can join a tag between reading its
+// members and deleting them.
+var invalidateScript = redis.NewScript(`
+for i = 1, #KEYS, 2 do
+	local keys = redis.call('SMEMBERS', KEYS[i])
+	for j = 1, #keys, 1000 do
+		redis.call('DEL', unpack(keys, j, math.min(j + 999, #keys)))
+	end
+	redis.call('DEL', KEYS[i])
+	redis.call('INCR', KEYS[i + 1])
+	redis.call('PEXPIRE', KEYS[i + 1], ARGV[1])
+end
+return 0
+`)
+
+func (c *redisCache) Invalidate(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(tags))
+	for _, tag := range tags {
+		keys = append(keys, tagKey(tag), genKey(tag))
+	}
+	if err := invalidateScript.Run(ctx, c.client, keys, tagTTL.Milliseconds()).Err(); err != nil {
+		return fmt.Errorf("error while invalidating %v in redis : %v", tags, err)
+	}
+	return nil
+}
+
+func tagKey(tag string) string {
+	return "cache:tag:" + tag
+}
+
+func genKey(tag string) string {
+	return "cache:gen:" + tag
+}
+
+func (c *redisCache) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("error while doing DEL command in redis : %v", err)
+	}
+	return nil
+}
+
+// memoryCache drops expired entries when they are read, and sweeps the rest once a minute.
+// Generations are never swept, there is one counter per tag ever invalidated.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	tags    map[string]map[string]struct{}
+	gens    map[string]int64
+	swept   time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: map[string]memoryEntry{}, tags: map[string]map[string]struct{}{}, gens: map[string]int64{}, swept: time.Now()}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	if ttl <= 0 {
+		return errNoTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, ttl, tags)
+	return nil
+}
+
+func (c *memoryCache) SetIfCurrent(_ context.Context, key string, value []byte, ttl time.Duration, tags []string, gens []int64) (bool, error) {
+	if ttl <= 0 {
+		return false, errNoTTL
+	}
+	if len(gens) != len(tags) {
+		return false, fmt.Errorf("%d generations for %d tags", len(gens), len(tags))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, tag := range tags {
+		if c.gens[tag] != gens[i] {
+			return false, nil
+		}
+	}
+	c.set(key, value, ttl, tags)
+	return true, nil
+}
+
+func (c *memoryCache) Generations(_ context.Context, tags ...string) ([]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gens := make([]int64, len(tags))
+	for i, tag := range tags {
+		gens[i] = c.gens[tag]
+	}
+	return gens, nil
+}
+
+// set stores an entry, c.mu must be held
+func (c *memoryCache) set(key string, value []byte, ttl time.Duration, tags []string) {
+	now := time.Now()
+	if now.Sub(c.swept) > time.Minute {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for tag, keys := range c.tags {
+			for k := range keys {
+				if _, ok := c.entries[k]; !ok {
+					delete(keys, k)
+				}
+			}
+			if len(keys) == 0 {
+				delete(c.tags, tag)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[key] = memoryEntry{value: append([]byte(nil), value...), expires: now.Add(ttl)}
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = map[string]struct{}{}
+		}
+		c.tags[tag][key] = struct{}{}
+	}
+}
+
+func (c *memoryCache) Invalidate(_ context.Context, tags ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		for key := range c.tags[tag] {
+			delete(c.entries, key)
+		}
+		delete(c.tags, tag)
+		c.gens[tag]++
+	}
+	return nil
+}
+
+func (c *memoryCache) Del(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+	return nil
+}
+
+type cacheNamespace struct {
+	Name    string
+	Version int
+	TTL     time.Duration
+}
+
+func (ns cacheNamespace) key(id string) string {
+	return fmt.Sprintf("cache:%s:v%d:%s", ns.Name, ns.Version, id)
+}
+
+// Stock counts change with every purchase, so tickets and merch are kept briefly
+var (
+	ticketListCache = cacheNamespace{Name: "tickets", Version: 1, TTL: time.Minute}
+	ticketCache     = cacheNamespace{Name: "ticket", Version: 1, TTL: time.Minute}
+	merchListCache  = cacheNamespace{Name: "merchlist", Version: 1, TTL: time.Minute}
+	merchCache      = cacheNamespace{Name: "merch", Version: 1, TTL: time.Minute}
+	mediaListCache  = cacheNamespace{Name: "medialist", Version: 1, TTL: 10 * time.Minute}
+	mediaCache      = cacheNamespace{Name: "media", Version: 1, TTL: 10 * time.Minute}
+	profileCache    = cacheNamespace{Name: "profile", Version: 1, TTL: 10 * time.Minute}
+	followersCache  = cacheNamespace{Name: "followers", Version: 1, TTL: 10 * time.Minute}
+	placesCache     = cacheNamespace{Name: "places", Version: 1, TTL: 5 * time.Minute}
+)
+
+// placesTag covers lists of places, which change with any place
+const placesTag = "places"
+
+func eventTag(eventID string) string { return "event:" + eventID }
+func placeTag(placeID string) string { return "place:" + placeID }
+func userTag(userID string) string   { return "user:" + userID }
+
+// entityTag is the tag of whatever media, merch or tickets hang off
+func entityTag(entityType, entityID string) string {
+	if entityType == "place" {
+		return placeTag(entityID)
+	}
+	return eventTag(entityID)
+}
+
+// invalidate drops everything cached under the tags, here and at the gateway (see edgepurge.go).
+// Failures are logged, the entries run out with their TTL regardless.
+func invalidate(ctx context.Context, tags ...string) {
+	if err := appCache.Invalidate(ctx, tags...); err != nil {
+		log.Printf("Cache invalidation failed for %v: %v", tags, err)
+	}
+	purgeEdge(tags)
+}
+
+// cacheGet reads id from the namespace. Errors count as misses, the caller goes to Mongo.
+func cacheGet[T any](ctx context.Context, ns cacheNamespace, id string) (value T, ok bool) {
+	data, ok, err := appCache.Get(ctx, ns.key(id))
+	if err != nil {
+		log.Printf("Cache read failed for %s: %v", ns.key(id), err)
+		return value, false
+	}
+	if !ok {
+		return value, false
+	}
+	if err := json.Unmarshal(data, &value); err != nil {
+		log.Printf("Dropping undecodable cache entry %s: %v", ns.key(id), err)
+		appCache.Del(ctx, ns.key(id))
+		return value, false
+	}
+	return value, true
+}
+
+func cacheSet[T any](ctx context.Context, ns cacheNamespace, id string, value T, tags ...string) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return appCache.Set(ctx, ns.key(id), data, ns.TTL, tags...)
+}
+
+func cacheDel(ctx context.Context, ns cacheNamespace, ids ...string) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = ns.key(id)
+	}
+	return appCache.Del(ctx, keys...)
+}
+
+// cached returns id from the cache, or calls load on a miss and caches what it returns under tags.
+// Concurrent misses for the same key wait for one load instead of all going to Mongo.
+func cached[T any](ctx context.Context, ns cacheNamespace, id string, load func() (T, error), tags ...string) (T, error) {
+	if value, ok := cacheGet[T](ctx, ns, id); ok {
+		return value, nil
+	}
+	key := ns.key(id)
+	v, err, _ := cacheFlight.Do(key, func() (interface{}, error) {
+		gens, genErr := appCache.Generations(ctx, tags...)
+		value, err := load()
+		if err != nil {
+			return nil, err
+		}
+		if genErr != nil {
+			// Without the generations there's no telling whether the value is already stale
+			log.Printf("Cache write skipped for %s: %v", key, genErr)
+			return value, nil
+		}
+		data, err := json.Marshal(value)
+		if err == nil {
+			_, err = appCache.SetIfCurrent(ctx, key, data, ns.TTL, tags, gens)
+		}
+		if err != nil {
+			log.Printf("Cache write failed for %s: %v", key, err)
+		}
+		return value, nil
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return v.(T), nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// useMemoryCache points appCache at a fresh memory cache for the duration of the test
+func useMemoryCache(t *testing.T) {
+	t.Helper()
+	prev := appCache
+	appCache = newMemoryCache()
+	t.Cleanup(func() { appCache = prev })
+}
+
+// useRedisCache points appCache at a Redis cache on a fresh miniredis
+func useRedisCache(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := useMiniredis(t)
+	prev := appCache
+	appCache = &redisCache{client: conn}
+	t.Cleanup(func() { appCache = prev })
+	return mr
+}
+
+// eachBackend runs test once against every cache backend
+func eachBackend(t *testing.T, test func(t *testing.T)) {
+	backends := map[string]func(*testing.T){
+		"memory": useMemoryCache,
+		"redis":  func(t *testing.T) { useRedisCache(t) },
+	}
+	for name, use := range backends {
+		t.Run(name, func(t *testing.T) {
+			use(t)
+			test(t)
+		})
+	}
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	c := newMemoryCache()
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "k", []byte("v"), 0); err != errNoTTL {
+		t.Fatalf("set without ttl: got %v, want errNoTTL", err)
+	}
+	if err := c.Set(ctx, "k", []byte("v"), 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, _ := c.Get(ctx, "k"); !ok || string(value) != "v" {
+		t.Fatalf("got %q %v, want a hit", value, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, _ := c.Get(ctx, "k"); ok {
+		t.Fatal("entry outlived its ttl")
+	}
+}
+
+func TestRedisCacheTTL(t *testing.T) {
+	mr := useRedisCache(t)
+	ctx := context.Background()
+
+	if err := appCache.Set(ctx, "k", []byte("v"), 0); err != errNoTTL {
+		t.Fatalf("set without ttl: got %v, want errNoTTL", err)
+	}
+	if _, err := appCache.SetIfCurrent(ctx, "k", []byte("v"), 0, nil, nil); err != errNoTTL {
+		t.Fatalf("conditional set without ttl: got %v, want errNoTTL", err)
+	}
+	if err := appCache.Set(ctx, "k", []byte("v"), time.Minute, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appCache.SetIfCurrent(ctx, "k2", []byte("v"), 2*time.Minute, []string{"t"}, []int64{0}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("k"); ttl != time.Minute {
+		t.Fatalf("k expires in %v, want a minute", ttl)
+	}
+	if ttl := mr.TTL("k2"); ttl != 2*time.Minute {
+		t.Fatalf("k2 expires in %v, want two minutes", ttl)
+	}
+	if ttl := mr.TTL(tagKey("t")); ttl != tagTTL {
+		t.Fatalf("tag expires in %v, want %v", ttl, tagTTL)
+	}
+	if value, ok, _ := appCache.Get(ctx, "k"); !ok || string(value) != "v" {
+		t.Fatalf("got %q %v, want a hit", value, ok)
+	}
+
+	mr.FastForward(time.Minute + time.Second)
+	if _, ok, _ := appCache.Get(ctx, "k"); ok {
+		t.Fatal("entry outlived its ttl")
+	}
+	if _, ok, _ := appCache.Get(ctx, "k2"); !ok {
+		t.Fatal("k2 expired with k")
+	}
+}
+
+func TestCacheDel(t *testing.T) {
+	eachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		appCache.Set(ctx, "a", []byte("1"), time.Minute)
+		appCache.Set(ctx, "b", []byte("2"), time.Minute)
+
+		if err := appCache.Del(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, _ := appCache.Get(ctx, "a"); ok {
+			t.Fatal("a survived Del")
+		}
+		if _, ok, _ := appCache.Get(ctx, "b"); !ok {
+			t.Fatal("b was deleted too")
+		}
+		if err := appCache.Del(ctx); err != nil {
+			t.Fatalf("Del of nothing: %v", err)
+		}
+	})
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	eachBackend(t, testCacheNamespaces)
+}
+
+func testCacheNamespaces(t *testing.T) {
+	ctx := context.Background()
+	v1 := cacheNamespace{Name: "thing", Version: 1, TTL: time.Minute}
+	v2 := cacheNamespace{Name: "thing", Version: 2, TTL: time.Minute}
+	other := cacheNamespace{Name: "other", Version: 1, TTL: time.Minute}
+
+	if key := v1.key("42"); key != "cache:thing:v1:42" {
+		t.Fatalf("key is %q", key)
+	}
+
+	if err := cacheSet(ctx, v1, "42", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := cacheGet[[]string](ctx, v1, "42"); !ok || len(value) != 2 || value[1] != "b" {
+		t.Fatalf("got %v %v, want the stored value", value, ok)
+	}
+	if _, ok := cacheGet[[]string](ctx, v2, "42"); ok {
+		t.Fatal("a new version saw entries of the old one")
+	}
+	if _, ok := cacheGet[[]string](ctx, other, "42"); ok {
+		t.Fatal("namespaces share entries")
+	}
+
+	// An entry that no longer decodes is a miss and gets dropped
+	if err := cacheSet(ctx, v1, "43", "not a list"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cacheGet[[]string](ctx, v1, "43"); ok {
+		t.Fatal("undecodable entry was returned")
+	}
+	if _, ok, _ := appCache.Get(ctx, v1.key("43")); ok {
+		t.Fatal("undecodable entry was kept")
+	}
+
+	if err := cacheDel(ctx, v1, "42"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cacheGet[[]string](ctx, v1, "42"); ok {
+		t.Fatal("entry survived cacheDel")
+	}
+}
+
+func TestCachedCollapsesConcurrentMisses(t *testing.T) {
+	eachBackend(t, testCachedCollapsesConcurrentMisses)
+}
+
+func testCachedCollapsesConcurrentMisses(t *testing.T) {
+	ns := cacheNamespace{Name: "flight", Version: 1, TTL: time.Minute}
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func() (string, error) {
+		loads.Add(1)
+		<-release
+		return "loaded", nil
+	}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	results := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cached(context.Background(), ns, "1", load)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- value
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let every caller miss and join the flight
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("%d loads for %d concurrent misses, want 1", n, callers)
+	}
+	for value := range results {
+		if value != "loaded" {
+			t.Fatalf("caller got %q", value)
+		}
+	}
+
+	// Now it's cached
+	value, _ := cached(context.Background(), ns, "1", load)
+	if value != "loaded" || loads.Load() != 1 {
+		t.Fatal("second call went back to the loader")
+	}
+}
+
+func TestCachedDoesNotCacheErrors(t *testing.T) {
+	eachBackend(t, testCachedDoesNotCacheErrors)
+}
+
+func testCachedDoesNotCacheErrors(t *testing.T) {
+	ns := cacheNamespace{Name: "errors", Version: 1, TTL: time.Minute}
+	boom := errors.New("boom")
+
+	if _, err := cached(context.Background(), ns, "1", func() (int, error) { return 0, boom }); err != boom {
+		t.Fatalf("got %v, want the load error", err)
+	}
+	value, err := cached(context.Background(), ns, "1", func() (int, error) { return 7, nil })
+	if err != nil || value != 7 {
+		t.Fatalf("got %d %v, want a fresh load", value, err)
+	}
+}
+
+func TestCacheTagInvalidation(t *testing.T) {
+	eachBackend(t, testCacheTagInvalidation)
+}
+
+func testCacheTagInvalidation(t *testing.T) {
+	ctx := context.Background()
+
+	cacheSet(ctx, ticketListCache, "e1", []Ticket{}, eventTag("e1"))
+	cacheSet(ctx, mediaListCache, "event:e1", []Media{}, eventTag("e1"), placesTag)
+	cacheSet(ctx, ticketListCache, "e2", []Ticket{}, eventTag("e2"))
+	cacheSet(ctx, profileCache, "u1", User{}, userTag("u1"))
+
+	invalidate(ctx, eventTag("e1"))
+
+	if _, ok := cacheGet[[]Ticket](ctx, ticketListCache, "e1"); ok {
+		t.Fatal("tickets of e1 survived invalidation")
+	}
+	if _, ok := cacheGet[[]Media](ctx, mediaListCache, "event:e1"); ok {
+		t.Fatal("media of e1 survived invalidation")
+	}
+	if _, ok := cacheGet[[]Ticket](ctx, ticketListCache, "e2"); !ok {
+		t.Fatal("tickets of e2 were invalidated too")
+	}
+	if _, ok := cacheGet[User](ctx, profileCache, "u1"); !ok {
+		t.Fatal("profile was invalidated too")
+	}
+
+	// An entry set again after invalidation is tagged afresh
+	cacheSet(ctx, ticketListCache, "e1", []Ticket{}, eventTag("e1"))
+	invalidate(ctx, eventTag("e1"), userTag("u1"))
+	if _, ok := cacheGet[[]Ticket](ctx, ticketListCache, "e1"); ok {
+		t.Fatal("re-cached tickets of e1 survived invalidation")
+	}
+	if _, ok := cacheGet[User](ctx, profileCache, "u1"); ok {
+		t.Fatal("profile survived invalidation of its tag")
+	}
+
+	if got := entityTag("place", "p1"); got != placeTag("p1") {
+		t.Fatalf("entityTag for a place is %q", got)
+	}
+	if got := entityTag("event", "e1"); got != eventTag("e1") {
+		t.Fatalf("entityTag for an event is %q", got)
+	}
+}
+
+func TestCachedDropsLoadsRacingInvalidation(t *testing.T) {
+	eachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		ns := cacheNamespace{Name: "race", Version: 1, TTL: time.Minute}
+
+		// The write lands while the load is reading the old state
+		value, err := cached(ctx, ns, "e1", func() (string, error) {
+			invalidate(ctx, eventTag("e1"))
+			return "stale", nil
+		}, eventTag("e1"), placesTag)
+		if err != nil || value != "stale" {
+			t.Fatalf("got %q %v, want the loaded value", value, err)
+		}
+		if _, ok := cacheGet[string](ctx, ns, "e1"); ok {
+			t.Fatal("a load that raced an invalidation was cached")
+		}
+
+		// The next load starts after the write and is cached again
+		cached(ctx, ns, "e1", func() (string, error) { return "fresh", nil }, eventTag("e1"), placesTag)
+		if value, ok := cacheGet[string](ctx, ns, "e1"); !ok || value != "fresh" {
+			t.Fatalf("got %q %v, want the fresh value cached", value, ok)
+		}
+	})
+}
+
+func TestSetIfCurrent(t *testing.T) {
+	eachBackend(t, func(t *testing.T) {
+		ctx := context.Background()
+		tags := []string{eventTag("e1"), placeTag("p1")}
+		gens, err := appCache.Generations(ctx, tags...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gens) != 2 || gens[0] != 0 || gens[1] != 0 {
+			t.Fatalf("generations of tags never invalidated are %v", gens)
+		}
+
+		if stored, err := appCache.SetIfCurrent(ctx, "k1", []byte("v"), time.Minute, tags, gens); err != nil || !stored {
+			t.Fatalf("got %v %v, want it stored", stored, err)
+		}
+		invalidate(ctx, placeTag("p1"))
+		if _, ok, _ := appCache.Get(ctx, "k1"); ok {
+			t.Fatal("k1 survived the invalidation of one of its tags")
+		}
+		if stored, _ := appCache.SetIfCurrent(ctx, "k1", []byte("v"), time.Minute, tags, gens); stored {
+			t.Fatal("stored with generations from before the invalidation")
+		}
+
+		now, _ := appCache.Generations(ctx, tags...)
+		if now[0] != gens[0] || now[1] != gens[1]+1 {
+			t.Fatalf("generations went from %v to %v", gens, now)
+		}
+		if _, err := appCache.SetIfCurrent(ctx, "k1", []byte("v"), time.Minute, tags, now[:1]); err == nil {
+			t.Fatal("generations that don't match the tags were accepted")
+		}
+	})
+}
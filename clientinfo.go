@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Requests normally arrive through the gateway, so RemoteAddr is the gateway and not the user.
+// The client's address and scheme are taken from Forwarded or X-Forwarded-* instead, but only
+// when the connection comes from a proxy listed in TRUSTED_PROXIES (IPs or CIDRs, comma separated).
+// Anybody else could put whatever they like in those headers.
+
+type clientInfo struct {
+	IP     string
+	Scheme string
+}
+
+const clientInfoKey contextKey = "clientInfo"
+
+var trustedProxies []*net.IPNet
+
+func loadTrustedProxies() error {
+	nets, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop is one proxy's account of the request it received
+type forwardedHop struct {
+	For   string
+	Proto string
+}
+
+// parseForwarded reads an RFC 7239 Forwarded header, nearest proxy last
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.Trim(val, `"`)
+				switch strings.ToLower(name) {
+				case "for":
+					hop.For = forwardedNode(val)
+				case "proto":
+					hop.Proto = strings.ToLower(val)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips ports and IPv6 brackets, e.g. "[2001:db8::1]:4711" or "192.0.2.60:443"
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+// parseXForwarded turns X-Forwarded-For and X-Forwarded-Proto into hops, nearest proxy last
+func parseXForwarded(header http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			hops = append(hops, forwardedHop{For: forwardedNode(strings.TrimSpace(addr))})
+		}
+	}
+	// X-Forwarded-Proto is set by the edge proxy rather than appended to, so it goes with the nearest hop
+	var protos []string
+	for _, value := range header.Values("X-Forwarded-Proto") {
+		protos = append(protos, strings.Split(value, ",")...)
+	}
+	if len(hops) > 0 && len(protos) > 0 {
+		hops[len(hops)-1].Proto = strings.ToLower(strings.TrimSpace(protos[len(protos)-1]))
+	}
+	return hops
+}
+
+// resolveClient walks the forwarding chain back from our peer, through trusted proxies only.
+// The first address not belonging to a trusted proxy is the client.
+func resolveClient(r *http.Request) clientInfo {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	info := clientInfo{IP: peer, Scheme: "http"}
+	if r.TLS != nil {
+		info.Scheme = "https"
+	}
+	if !isTrustedProxy(peer) {
+		return info
+	}
+
+	hops := parseForwarded(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = parseXForwarded(r.Header)
+	}
+	scheme := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].Proto != "" {
+			scheme = hops[i].Proto
+		}
+		if net.ParseIP(hops[i].For) == nil {
+			// Obfuscated or unknown node, nothing further back can be believed
+			break
+		}
+		info.IP = hops[i].For
+		if !isTrustedProxy(hops[i].For) {
+			break
+		}
+	}
+	if scheme == "http" || scheme == "https" {
+		info.Scheme = scheme
+	}
+	return info
+}
+
+// withClientInfo resolves the client once per request and stores it in the context
+func withClientInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientInfoKey, resolveClient(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP is the address of the client, without the port so reconnecting doesn't look like a new client
+func clientIP(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoKey).(clientInfo); ok {
+		return info.IP
+	}
+	return resolveClient(r).IP
+}
+
+// clientScheme is the scheme the client used to reach us, "http" or "https"
+func clientScheme(r *http.Request) string {
+	if info, ok := r.Context().Value(clientInfoKey).(clientInfo); ok {
+		return info.Scheme
+	}
+	return resolveClient(r).Scheme
+}
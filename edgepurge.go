@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The gateway caches anonymous GETs of events, places and media at the edge. invalidate()
+// purges the paths built from the tags it drops through the gateway's admin endpoint, set
+// GATEWAY_ADMIN_URL (e.g. http://127.0.0.1:9090) to enable it. Tickets and merch change with
+// every sale, so they're sent with no-store and never cached there at all.
+
+const edgePurgeTimeout = 2 * time.Second
+
+var edgePurgeClient = &http.Client{Timeout: edgePurgeTimeout}
+
+type edgePurge struct {
+	Paths    []string `json:"paths"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// edgePurgeFor maps cache tags to the gateway paths serving what they cover
+func edgePurgeFor(tags []string) edgePurge {
+	var purge edgePurge
+	for _, tag := range tags {
+		kind, id, _ := strings.Cut(tag, ":")
+		switch {
+		case tag == placesTag:
+			purge.Prefixes = append(purge.Prefixes, "/api/places")
+		case kind == "event":
+			purge.Paths = append(purge.Paths, "/api/event/"+id)
+			purge.Prefixes = append(purge.Prefixes, "/api/event/"+id+"/", "/api/media/event/"+id+"?", "/api/media/event/"+id+"/", "/api/events")
+		case kind == "place":
+			purge.Paths = append(purge.Paths, "/api/place/"+id)
+			purge.Prefixes = append(purge.Prefixes, "/api/place/"+id+"/", "/api/media/place/"+id+"?", "/api/media/place/"+id+"/")
+		}
+	}
+	return purge
+}
+
+// purgeEdge asks the gateway to drop what the tags cover. It doesn't hold the write up;
+// failures are logged and the entries run out with the route's ttl.
+func purgeEdge(tags []string) {
+	adminURL := os.Getenv("GATEWAY_ADMIN_URL")
+	if adminURL == "" {
+		return
+	}
+	purge := edgePurgeFor(tags)
+	if len(purge.Paths) == 0 && len(purge.Prefixes) == 0 {
+		return
+	}
+	body, err := json.Marshal(purge)
+	if err != nil {
+		log.Printf("Edge purge failed for %v: %v", tags, err)
+		return
+	}
+	go func() {
+		resp, err := edgePurgeClient.Post(strings.TrimSuffix(adminURL, "/")+"/admin/cache/purge", "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Edge purge failed for %v: %v", tags, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Edge purge failed for %v: gateway answered %s", tags, resp.Status)
+		}
+	}()
+}
+
+// noStore keeps the response out of every cache between the API and the client
+func noStore(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Cache-Control", "no-store")
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestInvalidatePurgesTheEdge(t *testing.T) {
+	useMemoryCache(t)
+	purges := make(chan edgePurge, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/admin/cache/purge" {
+			t.Errorf("got %s %s", r.Method, r.URL.Path)
+		}
+		var purge edgePurge
+		json.NewDecoder(r.Body).Decode(&purge)
+		purges <- purge
+	}))
+	defer gateway.Close()
+	t.Setenv("GATEWAY_ADMIN_URL", gateway.URL)
+
+	invalidate(context.Background(), eventTag("e1"), userTag("u1"))
+
+	select {
+	case purge := <-purges:
+		if !slices.Contains(purge.Paths, "/api/event/e1") {
+			t.Fatalf("event itself isn't purged: %+v", purge)
+		}
+		for _, prefix := range []string{"/api/event/e1/", "/api/media/event/e1?", "/api/events"} {
+			if !slices.Contains(purge.Prefixes, prefix) {
+				t.Fatalf("%s isn't purged: %+v", prefix, purge)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the gateway wasn't asked to purge")
+	}
+
+	// Tags the edge doesn't cache anything for don't call it
+	invalidate(context.Background(), userTag("u1"))
+	select {
+	case purge := <-purges:
+		t.Fatalf("purged %+v for a user", purge)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNoStore(t *testing.T) {
+	rec := httptest.NewRecorder()
+	noStore(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {})(rec, httptest.NewRequest("GET", "/api/event/e1/ticket", nil), nil)
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control is %q", got)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deleting an account schedules an erasure job. Until the grace period is over the user can
+// still log in and cancel it; afterwards the worker erases or anonymizes everything tied to
+// the account and keeps a report of what it removed.
+
+const (
+	defaultDeletionGrace = 14 * 24 * time.Hour
+	erasureInterval      = time.Minute
+
+	deletionPending   = "pending"
+	deletionCancelled = "cancelled"
+	deletionRunning   = "running"
+	deletionDone      = "done"
+	deletionFailed    = "failed"
+)
+
+func deletionCollection() *mongo.Collection {
+	return client.Database("eventdb").Collection("deletion_jobs")
+}
+
+// deletionGrace reads ACCOUNT_DELETION_GRACE (a Go duration such as "336h"), defaulting to 14 days
+func deletionGrace() time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultDeletionGrace
+}
+
+// deleteProfile schedules the erasure of the logged in account
+func deleteProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var existing DeletionJob
+	err := deletionCollection().FindOne(context.TODO(), bson.M{"userid": userID, "status": deletionPending}).Decode(&existing)
+	if err == nil {
+		sendResponse(w, http.StatusAccepted, existing, "Account deletion already scheduled", nil)
+		return
+	} else if err != mongo.ErrNoDocuments {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	jobID, err := generateTokenID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	job := DeletionJob{
+		JobID:        jobID,
+		UserID:       userID,
+		Username:     user.Username,
+		Status:       deletionPending,
+		RequestedAt:  now,
+		ScheduledFor: now.Add(deletionGrace()),
+	}
+	if _, err := deletionCollection().InsertOne(context.TODO(), job); err != nil {
+		http.Error(w, "Error scheduling deletion", http.StatusInternalServerError)
+		log.Printf("Error scheduling deletion of user %s: %v", userID, err)
+		return
+	}
+
+	log.Printf("Deletion of user %s scheduled for %s", userID, job.ScheduledFor.Format(time.RFC3339))
+	sendResponse(w, http.StatusAccepted, job, "Account deletion scheduled", nil)
+}
+
+// cancelProfileDeletion stops a scheduled deletion while it is still pending
+func cancelProfileDeletion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := deletionCollection().UpdateOne(
+		context.TODO(),
+		bson.M{"userid": userID, "status": deletionPending},
+		bson.M{"$set": bson.M{"status": deletionCancelled, "finished_at": time.Now()}},
+	)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		http.Error(w, "No pending deletion", http.StatusNotFound)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, nil, "Account deletion cancelled", nil)
+}
+
+// getProfileDeletion shows the user's latest deletion job
+func getProfileDeletion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var job DeletionJob
+	opts := options.FindOne().SetSort(bson.D{{Key: "requested_at", Value: -1}})
+	err := deletionCollection().FindOne(context.TODO(), bson.M{"userid": userID}, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "No deletion requested", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, job)
+}
+
+// getDeletionJob lets admins read a job and its report after the account is gone
+func getDeletionJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var job DeletionJob
+	err := deletionCollection().FindOne(context.TODO(), bson.M{"jobid": ps.ByName("id")}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, job)
+}
+
+// startErasureWorker runs due deletion jobs in the background
+func startErasureWorker() {
+	go func() {
+		ticker := time.NewTicker(erasureInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			runDueDeletions()
+		}
+	}()
+}
+
+// runDueDeletions claims due jobs one at a time, so several instances can run the worker
+func runDueDeletions() {
+	for {
+		var job DeletionJob
+		err := deletionCollection().FindOneAndUpdate(
+			context.TODO(),
+			bson.M{"status": deletionPending, "scheduled_for": bson.M{"$lte": time.Now()}},
+			bson.M{"$set": bson.M{"status": deletionRunning, "started_at": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			return
+		} else if err != nil {
+			log.Printf("Error claiming deletion job: %v", err)
+			return
+		}
+
+		report, err := eraseAccount(job.UserID, job.Username)
+		status := deletionDone
+		if err != nil {
+			status = deletionFailed
+			report.Errors = append(report.Errors, err.Error())
+		}
+		log.Printf("Deletion job %s for user %s finished with status %s: %+v", job.JobID, job.UserID, status, report)
+
+		_, err = deletionCollection().UpdateOne(
+			context.TODO(),
+			bson.M{"jobid": job.JobID},
+			bson.M{"$set": bson.M{"status": status, "finished_at": time.Now(), "report": report}},
+		)
+		if err != nil {
+			log.Printf("Error saving report of deletion job %s: %v", job.JobID, err)
+		}
+	}
+}
+
+// eraseAccount removes or anonymizes everything belonging to the user. Steps that fail are
+// noted in the report and the rest still runs; the user document goes last so a failed job
+// can be retried.
+func eraseAccount(userID, username string) (DeletionReport, error) {
+	report := DeletionReport{Removed: map[string]int64{}}
+	ctx := context.TODO()
+	note := func(step string, err error) {
+		if err != nil {
+			report.Errors = append(report.Errors, step+": "+err.Error())
+		}
+	}
+	removeFile := func(path string) {
+		err := os.Remove(path)
+		if err == nil {
+			report.Files++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			note("file "+path, err)
+		}
+	}
+
+	// Sign-ins
+	note("sessions", revokeUserSessions(userID))
+	res, err := patCollection().DeleteMany(ctx, bson.M{"userid": userID})
+	note("access tokens", err)
+	if res != nil {
+		report.Removed["access_tokens"] = res.DeletedCount
+	}
+
+	// Posts and their uploads
+	posts := client.Database("twitterClone").Collection("posts")
+	var userPosts []Post
+	cursor, err := posts.Find(ctx, bson.M{"userid": userID})
+	if err == nil {
+		err = cursor.All(ctx, &userPosts)
+	}
+	note("posts", err)
+	for _, post := range userPosts {
+		for _, path := range post.Media {
+			removeFile(filepath.Join(uploadDir, filepath.Base(path)))
+		}
+	}
+	res, err = posts.DeleteMany(ctx, bson.M{"userid": userID})
+	note("posts", err)
+	if res != nil {
+		report.Removed["posts"] = res.DeletedCount
+	}
+
+	// Media uploaded to events and places
+	media := client.Database("eventdb").Collection("media")
+	var userMedia []Media
+	cursor, err = media.Find(ctx, bson.M{"creatorid": userID})
+	if err == nil {
+		err = cursor.All(ctx, &userMedia)
+	}
+	note("media", err)
+	for _, m := range userMedia {
+		if m.URL != "" {
+			removeFile(filepath.Join(uploadDir, filepath.Base(m.URL)))
+		}
+		invalidate(ctx, entityTag(m.EntityType, m.EntityID))
+	}
+	res, err = media.DeleteMany(ctx, bson.M{"creatorid": userID})
+	note("media", err)
+	if res != nil {
+		report.Removed["media"] = res.DeletedCount
+	}
+
+	// Events go together with their tickets, media and merch
+	events := client.Database("eventdb").Collection("events")
+	var userEvents []Event
+	cursor, err = events.Find(ctx, bson.M{"creatorid": userID})
+	if err == nil {
+		err = cursor.All(ctx, &userEvents)
+	}
+	note("events", err)
+	for _, event := range userEvents {
+		note("event "+event.EventID, deleteRelatedData(event.EventID))
+		removeFile(filepath.Join("eventpic", event.EventID+".jpg"))
+		invalidate(ctx, eventTag(event.EventID))
+	}
+	res, err = events.DeleteMany(ctx, bson.M{"creatorid": userID})
+	note("events", err)
+	if res != nil {
+		report.Removed["events"] = res.DeletedCount
+	}
+
+	// Places are shared listings other content points to, so they stay but lose their creator
+	res2, err := client.Database("eventdb").Collection("places").UpdateMany(ctx, bson.M{"createdBy": userID}, bson.M{"$set": bson.M{"createdBy": ""}})
+	note("places", err)
+	if res2 != nil {
+		report.Anonymized = append(report.Anonymized, fmt.Sprintf("places: %d", res2.ModifiedCount))
+	}
+	invalidate(ctx, placesTag)
+
+	// Businesses lose the account as an owner
+	res2, err = client.Database("places_db").Collection("businesses").UpdateMany(ctx, bson.M{"owners": userID}, bson.M{"$pull": bson.M{"owners": userID}})
+	note("businesses", err)
+	if res2 != nil {
+		report.Anonymized = append(report.Anonymized, fmt.Sprintf("business ownerships: %d", res2.ModifiedCount))
+	}
+
+	// Bookings are the business's records, only the name goes
+	res2, err = client.Database("places_db").Collection("bookings").UpdateMany(ctx, bson.M{"user_name": username}, bson.M{"$set": bson.M{"user_name": "deleted user"}})
+	note("bookings", err)
+	if res2 != nil {
+		report.Anonymized = append(report.Anonymized, fmt.Sprintf("bookings: %d", res2.ModifiedCount))
+	}
+
+	// Purchases stay in the organizers' sales figures without the buyer
+	res2, err = purchaseCollection().UpdateMany(ctx, bson.M{"userid": userID}, bson.M{"$set": bson.M{"userid": ""}})
+	note("purchases", err)
+	if res2 != nil {
+		report.Anonymized = append(report.Anonymized, fmt.Sprintf("purchases: %d", res2.ModifiedCount))
+	}
+
+	// Data exports hold a full copy of the account
+	var exports []ExportJob
+	note("exports", findAll(exportCollection(), bson.M{"userid": userID}, &exports))
+	for _, job := range exports {
+		note("export "+job.ExportID, removeExport(job))
+	}
+	res, err = exportCollection().DeleteMany(ctx, bson.M{"userid": userID})
+	note("exports", err)
+	if res != nil {
+		report.Removed["exports"] = res.DeletedCount
+	}
+
+	// Follow references on other accounts (older entries hold usernames)
+	refs := bson.A{userID, username}
+	res2, err = userCollection.UpdateMany(ctx, bson.M{"followers": bson.M{"$in": refs}}, bson.M{"$pull": bson.M{"followers": bson.M{"$in": refs}}})
+	note("followers", err)
+	if res2 != nil {
+		report.Removed["follower_refs"] = res2.ModifiedCount
+	}
+	res2, err = userCollection.UpdateMany(ctx, bson.M{"follows": bson.M{"$in": refs}}, bson.M{"$pull": bson.M{"follows": bson.M{"$in": refs}}})
+	note("follows", err)
+	if res2 != nil {
+		report.Removed["following_refs"] = res2.ModifiedCount
+	}
+
+	res, err = client.Database("your_database").Collection("activities").DeleteMany(ctx, bson.M{"username": username})
+	note("activities", err)
+	if res != nil {
+		report.Removed["activities"] = res.DeletedCount
+	}
+
+	// Profile and banner pictures
+	removeFile(filepath.Join("userpic", username+".jpg"))
+	removeFile(filepath.Join("userpic", "banner", username+".jpg"))
+	removeFile(filepath.Join("userpic", "thumb", userID+".jpg"))
+
+	invalidate(ctx, userTag(userID))
+	RdxHdel("users", userID)
+
+	if len(report.Errors) > 0 {
+		return report, fmt.Errorf("%d steps failed, keeping the account for a retry: %s", len(report.Errors), strings.Join(report.Errors, "; "))
+	}
+
+	res, err = userCollection.DeleteMany(ctx, bson.M{"userid": userID})
+	if err != nil {
+		return report, err
+	}
+	report.Removed["users"] = res.DeletedCount
+	return report, nil
+}
@@ -171,6 +171,7 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		http.Error(w, "Event not found", http.StatusNotFound)
 		return
 	}
+	invalidate(r.Context(), eventTag(eventID))
 
 	// Retrieve the updated event
 	var updatedEvent Event
@@ -326,38 +327,22 @@ func getEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func deleteEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 
-	// Get the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusBadRequest)
-		return
-	}
-
-	// Get the event details to verify the creator
+	// Ownership is checked by requireOwner
 	collection := client.Database("eventdb").Collection("events")
-	var event Event
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID}).Decode(&event)
+	result, err := collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID})
 	if err != nil {
-		http.Error(w, "Event not found", http.StatusNotFound)
-		return
-	}
-
-	// Check if the requesting user is the creator of the event
-	if event.CreatorID != requestingUserID {
-		log.Printf("User %s attempted to delete an event they did not create. EventID: %s", requestingUserID, eventID)
-		http.Error(w, "Unauthorized to delete this event", http.StatusForbidden)
+		http.Error(w, "error deleting event", http.StatusInternalServerError)
 		return
 	}
-
-	// Delete the event from MongoDB
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID})
-	if err != nil {
-		http.Error(w, "error deleting event", http.StatusInternalServerError)
+	if result.DeletedCount == 0 {
+		http.Error(w, "Event not found", http.StatusNotFound)
 		return
 	}
 
 	// Delete related data (tickets, media, merch)
-	if err := deleteRelatedData(eventID); err != nil {
+	err = deleteRelatedData(eventID)
+	invalidate(r.Context(), eventTag(eventID))
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -113,7 +113,7 @@ func deleteRelatedData(eventID string) error {
 		return fmt.Errorf("error deleting related media")
 	}
 
-	_, err = client.Database("eventdb").Collection("merch").DeleteMany(context.TODO(), bson.M{"eventid": eventID})
+	_, err = client.Database("eventdb").Collection("merch").DeleteMany(context.TODO(), merchFilter("event", eventID))
 	if err != nil {
 		return fmt.Errorf("error deleting related merch")
 	}
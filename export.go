@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Users can download everything we hold on them as a ZIP. Archives can get large, so they are
+// built in the background and handed out through a link that stops working when the archive expires.
+
+const (
+	exportLifetime = 48 * time.Hour
+	exportInterval = time.Minute
+	maxExportLinks = 5 // links handed out per export that still work, older ones stop
+
+	exportPending = "pending"
+	exportRunning = "running"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+	exportExpired = "expired"
+)
+
+// exportWake lets a new request start the worker without waiting for the next tick
+var exportWake = make(chan struct{}, 1)
+
+func exportCollection() *mongo.Collection {
+	return client.Database("eventdb").Collection("exports")
+}
+
+// exportDir is where archives are kept, outside of any directory served as static files
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return "./exports"
+}
+
+// requestExport queues an archive of the logged in user's data
+func requestExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var existing ExportJob
+	filter := bson.M{"userid": userID, "status": bson.M{"$in": bson.A{exportPending, exportRunning}}}
+	err := exportCollection().FindOne(context.TODO(), filter).Decode(&existing)
+	if err == nil {
+		sendResponse(w, http.StatusAccepted, existing, "Export already in progress", nil)
+		return
+	} else if err != mongo.ErrNoDocuments {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	exportID, err := generateTokenID()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	job := ExportJob{
+		ExportID:    exportID,
+		UserID:      userID,
+		Status:      exportPending,
+		RequestedAt: time.Now(),
+	}
+	if _, err := exportCollection().InsertOne(context.TODO(), job); err != nil {
+		http.Error(w, "Error starting export", http.StatusInternalServerError)
+		log.Printf("Error queueing export for user %s: %v", userID, err)
+		return
+	}
+
+	select {
+	case exportWake <- struct{}{}:
+	default:
+	}
+
+	sendResponse(w, http.StatusAccepted, job, "Export started, check back for the download link", nil)
+}
+
+// getExport shows the state of an export. Once it is ready every call hands out a fresh
+// download link. The last maxExportLinks of them keep working until the export expires, so
+// polling again or a second tab doesn't break a link the user is about to open.
+func getExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var job ExportJob
+	err := exportCollection().FindOne(context.TODO(), bson.M{"exportid": ps.ByName("id"), "userid": userID}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"export": job}
+	if job.Status == exportReady && time.Now().Before(job.ExpiresAt) {
+		token, err := generateSecureToken()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		_, err = exportCollection().UpdateOne(context.TODO(), bson.M{"exportid": job.ExportID},
+			bson.M{"$push": bson.M{"token_hashes": bson.M{"$each": bson.A{hashToken(token)}, "$slice": -maxExportLinks}}})
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		response["download_url"] = fmt.Sprintf("/api/profile/export/%s/download?token=%s", job.ExportID, token)
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// downloadExport serves the archive to whoever holds the link, so it works from a plain browser download
+func downloadExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+
+	var job ExportJob
+	err := exportCollection().FindOne(context.TODO(), bson.M{"exportid": ps.ByName("id"), "token_hashes": hashToken(token)}).Decode(&job)
+	if err != nil || job.Status != exportReady || time.Now().After(job.ExpiresAt) {
+		http.Error(w, "Link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(job.Path)
+	if err != nil {
+		log.Printf("Error opening export %s: %v", job.ExportID, err)
+		http.Error(w, "Link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="naevis-export-`+job.FinishedAt.Format("2006-01-02")+`.zip"`)
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", job.FinishedAt, file)
+}
+
+// startExportWorker builds queued archives and removes expired ones
+func startExportWorker() {
+	// Jobs left running by a previous process never finished, build them again
+	_, err := exportCollection().UpdateMany(context.TODO(), bson.M{"status": exportRunning}, bson.M{"$set": bson.M{"status": exportPending}})
+	if err != nil {
+		log.Printf("Error requeueing exports: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(exportInterval)
+		defer ticker.Stop()
+		for {
+			runPendingExports()
+			expireExports()
+			select {
+			case <-ticker.C:
+			case <-exportWake:
+			}
+		}
+	}()
+}
+
+func runPendingExports() {
+	for {
+		var job ExportJob
+		err := exportCollection().FindOneAndUpdate(
+			context.TODO(),
+			bson.M{"status": exportPending},
+			bson.M{"$set": bson.M{"status": exportRunning}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&job)
+		if err == mongo.ErrNoDocuments {
+			return
+		} else if err != nil {
+			log.Printf("Error claiming export: %v", err)
+			return
+		}
+
+		update := bson.M{"finished_at": time.Now()}
+		path, size, err := buildExport(job)
+		if err != nil {
+			log.Printf("Export %s for user %s failed: %v", job.ExportID, job.UserID, err)
+			update["status"] = exportFailed
+			update["error"] = "The archive could not be built, please try again"
+		} else {
+			log.Printf("Export %s for user %s ready (%d bytes)", job.ExportID, job.UserID, size)
+			update["status"] = exportReady
+			update["path"] = path
+			update["size"] = size
+			update["expires_at"] = time.Now().Add(exportLifetime)
+		}
+
+		if _, err := exportCollection().UpdateOne(context.TODO(), bson.M{"exportid": job.ExportID}, bson.M{"$set": update}); err != nil {
+			log.Printf("Error saving export %s: %v", job.ExportID, err)
+		}
+	}
+}
+
+// expireExports deletes archives whose link has run out
+func expireExports() {
+	cursor, err := exportCollection().Find(context.TODO(), bson.M{"status": exportReady, "expires_at": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		log.Printf("Error finding expired exports: %v", err)
+		return
+	}
+	var jobs []ExportJob
+	if err := cursor.All(context.TODO(), &jobs); err != nil {
+		log.Printf("Error finding expired exports: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		if err := removeExport(job); err != nil {
+			log.Printf("Error removing export %s: %v", job.ExportID, err)
+			continue
+		}
+		_, err := exportCollection().UpdateOne(context.TODO(), bson.M{"exportid": job.ExportID},
+			bson.M{"$set": bson.M{"status": exportExpired}, "$unset": bson.M{"path": "", "token_hashes": ""}})
+		if err != nil {
+			log.Printf("Error expiring export %s: %v", job.ExportID, err)
+		}
+	}
+}
+
+func removeExport(job ExportJob) error {
+	if job.Path == "" {
+		return nil
+	}
+	if err := os.Remove(job.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// buildExport writes the archive next to its final name and only renames it once complete
+func buildExport(job ExportJob) (string, int64, error) {
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		return "", 0, err
+	}
+	path := filepath.Join(exportDir(), job.ExportID+".zip")
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	zw := zip.NewWriter(file)
+	err = writeExport(zw, job.UserID)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), nil
+}
+
+// exportArchive adds JSON documents and files to the ZIP
+type exportArchive struct {
+	zw *zip.Writer
+}
+
+func (a exportArchive) json(name string, v interface{}) error {
+	f, err := a.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// file copies src into the archive. Missing files are skipped, uploads get deleted independently.
+func (a exportArchive) file(name, src string) error {
+	in, err := os.Open(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Uploads are already compressed, storing them saves a lot of CPU on big accounts
+	f, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	return err
+}
+
+// findAll decodes every document matching filter
+func findAll(coll *mongo.Collection, filter interface{}, results interface{}) error {
+	cursor, err := coll.Find(context.TODO(), filter)
+	if err != nil {
+		return err
+	}
+	return cursor.All(context.TODO(), results)
+}
+
+func writeExport(zw *zip.Writer, userID string) error {
+	a := exportArchive{zw: zw}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		return err
+	}
+	// PasswordHash is the only secret the JSON tags still let through
+	user.PasswordHash = ""
+	if err := a.json("profile.json", user); err != nil {
+		return err
+	}
+	if err := a.json("settings.json", user.Preferences); err != nil {
+		return err
+	}
+	if err := a.file("files/userpic/"+user.Username+".jpg", filepath.Join("userpic", user.Username+".jpg")); err != nil {
+		return err
+	}
+	if err := a.file("files/userpic/banner/"+user.Username+".jpg", filepath.Join("userpic", "banner", user.Username+".jpg")); err != nil {
+		return err
+	}
+
+	// Follows are stored as user IDs, add the usernames so the file is readable
+	var people []struct {
+		UserID   string `json:"userid" bson:"userid"`
+		Username string `json:"username" bson:"username"`
+	}
+	ids := append(append([]string{}, user.Follows...), user.Followers...)
+	if err := findAll(userCollection, bson.M{"userid": bson.M{"$in": ids}}, &people); err != nil {
+		return err
+	}
+	names := map[string]string{}
+	for _, p := range people {
+		names[p.UserID] = p.Username
+	}
+	named := func(ids []string) []map[string]string {
+		list := []map[string]string{}
+		for _, id := range ids {
+			list = append(list, map[string]string{"userid": id, "username": names[id]})
+		}
+		return list
+	}
+	if err := a.json("follows.json", map[string]interface{}{"follows": named(user.Follows), "followers": named(user.Followers)}); err != nil {
+		return err
+	}
+
+	posts := []Post{}
+	if err := findAll(client.Database("twitterClone").Collection("posts"), bson.M{"userid": userID}, &posts); err != nil {
+		return err
+	}
+	if err := a.json("posts.json", posts); err != nil {
+		return err
+	}
+	for _, post := range posts {
+		for _, path := range post.Media {
+			name := filepath.Base(path)
+			if err := a.file("files/posts/"+name, filepath.Join(uploadDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	media := []Media{}
+	if err := findAll(client.Database("eventdb").Collection("media"), bson.M{"creatorid": userID}, &media); err != nil {
+		return err
+	}
+	if err := a.json("media.json", media); err != nil {
+		return err
+	}
+	for _, m := range media {
+		if m.URL == "" {
+			continue
+		}
+		name := filepath.Base(m.URL)
+		if err := a.file("files/media/"+name, filepath.Join(uploadDir, name)); err != nil {
+			return err
+		}
+	}
+
+	events := []Event{}
+	if err := findAll(client.Database("eventdb").Collection("events"), bson.M{"creatorid": userID}, &events); err != nil {
+		return err
+	}
+	if err := a.json("events.json", events); err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := a.file("files/events/"+event.EventID+".jpg", filepath.Join("eventpic", event.EventID+".jpg")); err != nil {
+			return err
+		}
+	}
+
+	places := []Place{}
+	if err := findAll(client.Database("eventdb").Collection("places"), bson.M{"createdBy": userID}, &places); err != nil {
+		return err
+	}
+	if err := a.json("places.json", places); err != nil {
+		return err
+	}
+	for _, place := range places {
+		if err := a.file("files/places/"+place.PlaceID+".jpg", filepath.Join("placepic", place.PlaceID+".jpg")); err != nil {
+			return err
+		}
+	}
+
+	purchases := []Purchase{}
+	if err := findAll(purchaseCollection(), bson.M{"userid": userID}, &purchases); err != nil {
+		return err
+	}
+	if err := a.json("purchases.json", purchases); err != nil {
+		return err
+	}
+
+	bookings := []Booking{}
+	if err := findAll(client.Database("places_db").Collection("bookings"), bson.M{"user_name": user.Username}, &bookings); err != nil {
+		return err
+	}
+	if err := a.json("bookings.json", bookings); err != nil {
+		return err
+	}
+
+	activities := []Activity{}
+	if err := findAll(client.Database("your_database").Collection("activities"), bson.M{"username": user.Username}, &activities); err != nil {
+		return err
+	}
+	return a.json("activities.json", activities)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetExportKeepsEarlierLinks(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("ready", func(mt *mtest.T) {
+		prev := client
+		client = mt.Client
+		mt.Cleanup(func() { client = prev })
+
+		ns := "eventdb.exports"
+		ready := bson.D{
+			{Key: "exportid", Value: "x1"},
+			{Key: "userid", Value: "u1"},
+			{Key: "status", Value: exportReady},
+			{Key: "expires_at", Value: time.Now().Add(time.Hour)},
+		}
+		for poll := 0; poll < 2; poll++ {
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, ready), mtest.CreateSuccessResponse())
+
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/api/profile/export/x1", nil)
+			r = r.WithContext(context.WithValue(r.Context(), userIDKey, "u1"))
+			getExport(rec, r, httprouter.Params{{Key: "id", Value: "x1"}})
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "download_url") {
+				t.Fatalf("poll %d: got %d %s", poll, rec.Code, rec.Body.String())
+			}
+
+			update := mt.GetStartedEvent()
+			for update != nil && update.CommandName != "update" {
+				update = mt.GetStartedEvent()
+			}
+			if update == nil {
+				t.Fatalf("poll %d stored no link", poll)
+			}
+			change := update.Command.Lookup("updates", "0", "u").Document()
+			if _, err := change.LookupErr("$set", "token_hashes"); err == nil {
+				t.Fatalf("poll %d replaced the earlier links: %s", poll, change)
+			}
+			if slice := change.Lookup("$push", "token_hashes", "$slice").AsInt64(); slice != -maxExportLinks {
+				t.Fatalf("poll %d keeps %d links, want the last %d", poll, slice, maxExportLinks)
+			}
+		}
+	})
+}
@@ -5,13 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -220,26 +219,23 @@ func getPosts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 // Directory to store uploaded images/videos
 const uploadDir = "./uploads/"
 
-func createTweetPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	if len(tokenString) < 8 || !strings.HasPrefix(tokenString, "Bearer ") {
-		http.Error(w, "Unauthorized: Invalid token format", http.StatusUnauthorized)
-		return
+// lookupUsername reads the users hash, going to Mongo (and refilling the hash) when Redis misses or is down
+func lookupUsername(ctx context.Context, userID string) string {
+	if username, err := RdxHget("users", userID); err == nil && username != "" {
+		return username
 	}
-
-	// Extract the JWT token after "Bearer "
-	tokenString = tokenString[7:]
-	claims := &Claims{}
-
-	// Validate JWT token
-	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil {
-		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
-		return
+	var user User
+	if err := userCollection.FindOne(ctx, bson.M{"userid": userID}).Decode(&user); err != nil {
+		log.Printf("Error looking up username of %s: %v", userID, err)
+		return ""
+	}
+	if !redisDegraded() {
+		_ = RdxHset("users", userID, user.Username)
 	}
+	return user.Username
+}
 
+func createTweetPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Parse multipart form data (20 MB limit)
 	if err := r.ParseMultipartForm(20 << 20); err != nil {
 		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
@@ -252,7 +248,7 @@ func createTweetPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	username, _ := RdxHget("users", userid)
+	username := lookupUsername(r.Context(), userid)
 
 	// Extract post content and type
 	postType := r.FormValue("type")
@@ -275,7 +271,7 @@ func createTweetPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	}
 
 	var mediaPaths []string
-	// var err error
+	var err error
 	// Handle different post types
 	switch postType {
 	case "image":
@@ -448,29 +444,7 @@ func editPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Retrieve user information from JWT (authentication required)
-	tokenString := r.Header.Get("Authorization")
-	if len(tokenString) < 8 || !strings.HasPrefix(tokenString, "Bearer ") {
-		http.Error(w, "Unauthorized: Invalid token format", http.StatusUnauthorized)
-		return
-	}
-	tokenString = tokenString[7:]
-	claims := &Claims{}
-	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil {
-		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	userID := claims.UserID
-	if userID == "" {
-		http.Error(w, "Unauthorized: Missing user ID", http.StatusUnauthorized)
-		return
-	}
-
-	// Check ownership of the post
+	// Ownership is checked by requireOwner
 	postsCollection := client.Database("twitterClone").Collection("posts")
 	var existingPost Post
 	err = postsCollection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&existingPost)
@@ -482,11 +456,6 @@ func editPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		}
 		return
 	}
-	if existingPost.UserID != userID {
-		http.Error(w, "Unauthorized: You can only edit your own posts", http.StatusForbidden)
-		return
-	}
-
 	// Prepare the update document
 	updateFields := bson.M{}
 	if updatedPost.Text != "" {
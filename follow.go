@@ -3,74 +3,53 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func parseToken(r *http.Request) (*Claims, error) {
-	tokenString := r.Header.Get("Authorization")
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !token.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-	return claims, nil
-}
-
 func getFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	claims, err := parseToken(r)
+	claims, err := requestClaims(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	userKey := fmt.Sprintf("user:%s:followers", claims.Username)
-	cachedFollowers, err := RdxGet(userKey)
-	if err == nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedFollowers))
-		return
-	}
-
-	var user User
-	err = userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	followers, err := cached(r.Context(), followersCache, claims.UserID, func() ([]User, error) {
+		var user User
+		if err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user); err != nil {
+			return nil, err
+		}
+		followers := []User{}
+		for _, followerID := range user.Follows {
+			var follower User
+			if err := userCollection.FindOne(context.TODO(), bson.M{"userid": followerID}).Decode(&follower); err == nil {
+				followers = append(followers, follower)
+			}
+		}
+		return followers, nil
+	}, userTag(claims.UserID))
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	followers := []User{}
-	for _, followerID := range user.Follows {
-		var follower User
-		if err := userCollection.FindOne(context.TODO(), bson.M{"userid": followerID}).Decode(&follower); err == nil {
-			followers = append(followers, follower)
-		}
-	}
-
-	// Cache the followers list for the user
-	followersJSON, _ := json.Marshal(followers)
-	RdxSet(userKey, string(followersJSON))
-
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(followers)
 }
 
 // Handle retrieving following
 func getFollowing(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	claims := &Claims{}
-	jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	claims, err := requestClaims(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	var user User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	err = userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		log.Printf("User not found: %s", claims.Username)
@@ -89,7 +68,7 @@ func getFollowing(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 }
 
 func suggestFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	claims, err := parseToken(r)
+	claims, err := requestClaims(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -247,6 +226,7 @@ func toggleFollow(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		http.Error(w, "Failed to update follows", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), userTag(userId), userTag(followedUserId))
 
 	// Return the updated follow status in the response
 	response := map[string]bool{"isFollowing": !isFollowing} // Toggle status
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The admin endpoint shows the state of every upstream and purges the edge cache. It listens
+// on its own address, admin_listen in the config, which should not be reachable from outside.
+
+type instanceStatus struct {
+	URL          string     `json:"url"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Active       int64      `json:"active"`
+	Failures     int64      `json:"consecutive_failures"`
+}
+
+type upstreamStatus struct {
+	Name        string           `json:"name"`
+	Breaker     breakerStatus    `json:"circuit_breaker"`
+	Concurrency limiterStatus    `json:"concurrency"`
+	Instances   []instanceStatus `json:"instances"`
+}
+
+func upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rt := current.Load()
+	now := time.Now()
+	upstreams := []upstreamStatus{}
+	for _, p := range rt.pools {
+		status := upstreamStatus{
+			Name:        p.Name,
+			Breaker:     p.breaker.status(),
+			Concurrency: p.limiter.status(),
+		}
+		for _, inst := range p.Instances {
+			is := instanceStatus{
+				URL:      inst.URL.String(),
+				Healthy:  inst.healthy.Load(),
+				Active:   inst.active.Load(),
+				Failures: inst.failures.Load(),
+			}
+			if inst.ejected(now) {
+				until := time.Unix(0, inst.ejectedUntil.Load())
+				is.EjectedUntil = &until
+			}
+			status.Instances = append(status.Instances, is)
+		}
+		upstreams = append(upstreams, status)
+	}
+	sort.Slice(upstreams, func(i, j int) bool { return upstreams[i].Name < upstreams[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upstreams)
+}
+
+func startAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/upstreams", upstreamsHandler)
+	mux.HandleFunc("/admin/cache/purge", purgeHandler)
+	go func() {
+		log.Printf("Admin endpoint on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Admin endpoint stopped: %v", err)
+		}
+	}()
+}
+
+type purgeRequest struct {
+	Paths    []string `json:"paths"`    // exact paths, with any query string
+	Prefixes []string `json:"prefixes"` // everything under these
+}
+
+// purgeHandler drops cached responses, the backend calls it when content changes
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	purged := current.Load().cache.store.Purge(func(key string) bool {
+		for _, path := range req.Paths {
+			if strings.HasPrefix(key, path+"?") {
+				return true
+			}
+		}
+		for _, prefix := range req.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+	log.Printf("Purged %d cached responses", purged)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The gateway checks access tokens once at the edge. Each route says how:
+//   public   - the token is not looked at
+//   optional - a token, if sent, has to be valid
+//   required - a valid token has to be sent
+// Identity headers from clients are always removed. For valid tokens the gateway adds
+// X-Auth-* headers signed with GATEWAY_IDENTITY_SECRET, which the API shares.
+// Personal access tokens are opaque, they are passed on for the API to check.
+
+const (
+	authPublic   = "public"
+	authOptional = "optional"
+	authRequired = "required"
+
+	patPrefix            = "nvs_pat_"
+	jwksMinInterval      = time.Minute
+	identityHeaderPrefix = "X-Auth-"
+	identityVersion      = "v2" // v2 sends X-Auth-Issued-At in milliseconds
+)
+
+type AuthConfig struct {
+	JWKSURL string `json:"jwks_url"`
+}
+
+// The API issues iat with microseconds, parsing keeps them so X-Auth-Issued-At has its milliseconds
+func init() {
+	jwt.TimePrecision = time.Microsecond
+}
+
+// tokenClaims mirrors the claims the API puts in access tokens
+type tokenClaims struct {
+	Username  string `json:"username"`
+	UserID    string `json:"userId"`
+	SessionID string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type verifyKey struct {
+	alg string
+	key interface{}
+}
+
+// verifier holds the API's public keys, and the HS256 secret for deployments still using JWT_SECRET
+type verifier struct {
+	url    string
+	secret []byte
+
+	mu      sync.Mutex
+	keys    map[string]verifyKey
+	fetched time.Time
+}
+
+var (
+	identitySecret = []byte(os.Getenv("GATEWAY_IDENTITY_SECRET"))
+	jwksClient     = &http.Client{Timeout: 5 * time.Second}
+)
+
+func newVerifier(cfg AuthConfig) *verifier {
+	v := &verifier{url: cfg.JWKSURL, keys: map[string]verifyKey{}}
+	if secret := os.Getenv("GATEWAY_JWT_SECRET"); secret != "" {
+		v.secret = []byte(secret)
+	}
+	return v
+}
+
+// keyFunc resolves the key by kid, refetching the JWKS at most once a minute for unknown kids
+func (v *verifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		if v.secret == nil {
+			return nil, fmt.Errorf("HS256 tokens are not accepted without GATEWAY_JWT_SECRET")
+		}
+		return v.secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetched) > jwksMinInterval
+	v.mu.Unlock()
+	if !ok && stale && v.url != "" {
+		if err := v.refresh(); err != nil {
+			return nil, err
+		}
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.alg != "" && key.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+func (v *verifier) refresh() error {
+	resp, err := jwksClient.Get(v.url)
+	if err != nil {
+		return fmt.Errorf("error fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, v.url)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("error decoding JWKS: %w", err)
+	}
+
+	keys := map[string]verifyKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = verifyKey{alg: k.Alg, key: pub}
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetched = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (v *verifier) verify(tokenString string) (*tokenClaims, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, v.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA", "HS256"}),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserID == "" {
+		return nil, fmt.Errorf("token has no user")
+	}
+	return claims, nil
+}
+
+// signIdentity returns the signature over the identity headers. The API computes the same
+// string, keep the two in step. Method and path are included so headers can't be replayed elsewhere.
+func signIdentity(secret []byte, h http.Header, method, path string) string {
+	payload := strings.Join([]string{
+		identityVersion,
+		h.Get("X-Auth-User-Id"),
+		h.Get("X-Auth-Username"),
+		h.Get("X-Auth-Role"),
+		h.Get("X-Auth-Session-Id"),
+		h.Get("X-Auth-Token-Id"),
+		h.Get("X-Auth-Issued-At"),
+		h.Get("X-Auth-Expires"),
+		method,
+		path,
+	}, "\n")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate applies the route's auth mode, it returns false when it already answered
+func (v *verifier) authenticate(mode string, w http.ResponseWriter, r *http.Request) bool {
+	for name := range r.Header {
+		if strings.HasPrefix(name, identityHeaderPrefix) {
+			r.Header.Del(name)
+		}
+	}
+	if mode == authPublic || mode == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		if mode == authRequired {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, "Missing token", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	tokenString, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		http.Error(w, "Invalid token format", http.StatusUnauthorized)
+		return false
+	}
+	if strings.HasPrefix(tokenString, patPrefix) {
+		return true
+	}
+
+	claims, err := v.verify(tokenString)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+
+	r.Header.Set("X-Auth-User-Id", claims.UserID)
+	r.Header.Set("X-Auth-Username", claims.Username)
+	r.Header.Set("X-Auth-Role", claims.Role)
+	r.Header.Set("X-Auth-Session-Id", claims.SessionID)
+	r.Header.Set("X-Auth-Token-Id", claims.ID)
+	if claims.IssuedAt != nil {
+		r.Header.Set("X-Auth-Issued-At", strconv.FormatInt(claims.IssuedAt.UnixMilli(), 10))
+	}
+	r.Header.Set("X-Auth-Expires", strconv.FormatInt(claims.ExpiresAt.Unix(), 10))
+	r.Header.Set("X-Auth-Signature", signIdentity(identitySecret, r.Header, r.Method, r.URL.Path))
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Each upstream has a circuit breaker. After FailureThreshold failures in a row it opens and
+// requests are refused straight away for OpenFor, instead of piling up on a stalled backend.
+// Then a few probe requests go through (half-open); one success closes it, one failure reopens it.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+type breaker struct {
+	mu       sync.Mutex
+	cfg      BreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	probes   int // half-open requests in flight
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	return &breaker{cfg: cfg, state: breakerClosed}
+}
+
+// allow reports whether a request may go to the upstream
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < time.Duration(b.cfg.OpenFor) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record feeds the outcome of an allowed request back
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return // started before the breaker opened
+	case breakerHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+	}
+	if ok {
+		b.failures = 0
+		b.state = breakerClosed
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.cfg.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// cancel gives back an allowed request that ended without an outcome, e.g. the client left
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// retryAfter is how long until the breaker lets a probe through
+func (b *breaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return time.Duration(b.cfg.OpenFor) - time.Since(b.openedAt)
+}
+
+type breakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := breakerStatus{State: b.state, Failures: b.failures}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
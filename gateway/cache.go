@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routes with a "cache" block have their GET responses cached at the edge. Upstream
+// Cache-Control decides what is stored and for how long (s-maxage, max-age, no-store,
+// private, no-cache, stale-while-revalidate); the route's ttl only applies when the response
+// says nothing. Entries past their freshness are served stale while one background request
+// revalidates them with If-None-Match / If-Modified-Since, and beyond that window the client
+// waits for the revalidation. Requests carrying credentials always bypass the cache.
+//
+// Keys are the path and query; the Host is ignored since the gateway serves one site.
+// The backend purges entries through the admin endpoint, see purgeHandler.
+
+const (
+	defaultCacheBytes      = 64 << 20
+	defaultCacheEntryBytes = 1 << 20
+	revalidateTimeout      = time.Minute
+)
+
+type CacheConfig struct {
+	Backend       string `json:"backend"`         // only "memory" for now
+	MaxBytes      int    `json:"max_bytes"`       // 64MB by default
+	MaxEntryBytes int    `json:"max_entry_bytes"` // larger bodies aren't stored, 1MB by default
+}
+
+type RouteCacheConfig struct {
+	TTL                  Duration `json:"ttl"`                    // freshness when the upstream doesn't set one
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"` // likewise
+}
+
+// cacheStore is where entries live. The in-memory LRU is the only one so far,
+// a shared store would implement the same methods.
+type cacheStore interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(key string, entry *cacheEntry)
+	// Purge removes every key match returns true for and says how many went
+	Purge(match func(key string) bool) int
+	Len() int
+}
+
+type cacheEntry struct {
+	Vary   []string // set on the marker stored under the bare key of a varying response
+	Status int
+	Header http.Header
+	Body   []byte
+	Date   time.Time     // when the response was generated, allowing for the upstream's Age
+	Fresh  time.Duration // how long it can be served without asking the upstream
+	Stale  time.Duration // and after that, how long stale while revalidating
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.Date)
+}
+
+func (e *cacheEntry) size() int {
+	n := len(e.Body)
+	for name, values := range e.Header {
+		n += len(name)
+		for _, v := range values {
+			n += len(v)
+		}
+	}
+	return n + 256
+}
+
+// memoryStore is a size bounded LRU
+type memoryStore struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List // front is the most recently used
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *cacheEntry
+	size  int
+}
+
+func newMemoryStore(maxBytes int) *memoryStore {
+	return &memoryStore{maxBytes: maxBytes, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (s *memoryStore) Get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (s *memoryStore) Set(key string, entry *cacheEntry) {
+	item := &memoryItem{key: key, entry: entry, size: entry.size() + len(key)}
+	if item.size > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.remove(el)
+	}
+	s.items[key] = s.order.PushFront(item)
+	s.bytes += item.size
+	for s.bytes > s.maxBytes {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *memoryStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, el := range s.items {
+		if match(key) {
+			s.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+func (s *memoryStore) remove(el *list.Element) {
+	item := s.order.Remove(el).(*memoryItem)
+	delete(s.items, item.key)
+	s.bytes -= item.size
+}
+
+// edgeCache puts a store in front of the pools
+type edgeCache struct {
+	cfg          CacheConfig
+	store        cacheStore
+	revalidating sync.Map // keys with a background revalidation running
+}
+
+func newEdgeCache(cfg CacheConfig) *edgeCache {
+	return &edgeCache{cfg: cfg, store: newMemoryStore(cfg.MaxBytes)}
+}
+
+// cacheable is true for requests the cache may answer
+func cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.Path + "?" + r.URL.RawQuery
+}
+
+func variantKey(key string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// lookup finds the entry matching the request's Vary headers
+func (c *edgeCache) lookup(r *http.Request) *cacheEntry {
+	e, ok := c.store.Get(cacheKey(r))
+	if ok && e.Vary != nil {
+		e, ok = c.store.Get(variantKey(cacheKey(r), e.Vary, r))
+	}
+	if !ok {
+		return nil
+	}
+	return e
+}
+
+// serve answers from the cache where it can and goes to the pool where it can't
+func (c *edgeCache) serve(p *pool, route *RouteConfig, w http.ResponseWriter, r *http.Request) {
+	e := c.lookup(r)
+	if e != nil && !mustRevalidate(r) {
+		age := e.age(time.Now())
+		if age < e.Fresh {
+			serveEntry(w, r, e, "HIT")
+			return
+		}
+		if age < e.Fresh+e.Stale {
+			c.revalidate(p, route, r, e)
+			serveEntry(w, r, e, "STALE")
+			return
+		}
+	}
+	c.fetch(p, route, w, r, e)
+}
+
+// mustRevalidate is true when the client asks not to be given a stored response unchecked
+func mustRevalidate(r *http.Request) bool {
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if cc["max-age"] == "0" {
+		return true
+	}
+	return r.Header.Get("Pragma") == "no-cache"
+}
+
+// revalidate refreshes the entry in the background, once per key at a time
+func (c *edgeCache) revalidate(p *pool, route *RouteConfig, r *http.Request, e *cacheEntry) {
+	key := cacheKey(r)
+	if _, running := c.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+	out := r.Clone(ctx)
+	out.Method = http.MethodGet
+	go func() {
+		defer c.revalidating.Delete(key)
+		defer cancel()
+		c.fetch(p, route, nil, out, e)
+	}()
+}
+
+// fetch goes to the upstream and stores what comes back. With a stale entry the request is
+// made conditional, and a 304 refreshes the entry. w is nil for background revalidations.
+func (c *edgeCache) fetch(p *pool, route *RouteConfig, w http.ResponseWriter, r *http.Request, stale *cacheEntry) {
+	out := r
+	if stale != nil && (stale.Header.Get("ETag") != "" || stale.Header.Get("Last-Modified") != "") {
+		out = r.Clone(r.Context())
+		out.Method = http.MethodGet
+		for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+			out.Header.Del(name)
+		}
+		if etag := stale.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		} else {
+			out.Header.Set("If-Modified-Since", stale.Header.Get("Last-Modified"))
+		}
+	} else {
+		stale = nil
+	}
+
+	cw := &captureWriter{client: w, hold304: stale != nil, limit: c.cfg.MaxEntryBytes, header: http.Header{}}
+	forward(p, route, cw, out)
+	now := time.Now()
+
+	if stale != nil && cw.status == http.StatusNotModified {
+		refreshed := *stale
+		refreshed.Header = stale.Header.Clone()
+		for _, name := range []string{"Cache-Control", "Date", "Expires", "ETag", "Last-Modified"} {
+			if v := cw.header.Get(name); v != "" {
+				refreshed.Header.Set(name, v)
+			}
+		}
+		refreshed.Date = responseDate(cw.header, now)
+		refreshed.Fresh, refreshed.Stale, _ = freshness(refreshed.Header, route.Cache, now)
+		c.store.Set(storedKey(r, refreshed.Header), &refreshed)
+		if w != nil {
+			serveEntry(w, r, &refreshed, "REVALIDATED")
+		}
+		return
+	}
+	if out.Method != http.MethodGet || cw.overflow {
+		return
+	}
+	c.storeResponse(r, route, cw, now)
+}
+
+// storedKey is the key a response with header h is stored under for r
+func storedKey(r *http.Request, h http.Header) string {
+	key := cacheKey(r)
+	if vary := varyHeaders(h); vary != nil {
+		return variantKey(key, vary, r)
+	}
+	return key
+}
+
+func (c *edgeCache) storeResponse(r *http.Request, route *RouteConfig, cw *captureWriter, now time.Time) {
+	switch cw.status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return
+	}
+	if cw.header.Get("Set-Cookie") != "" {
+		return
+	}
+	fresh, stale, ok := freshness(cw.header, route.Cache, now)
+	if !ok {
+		return
+	}
+	if fresh == 0 && cw.header.Get("ETag") == "" && cw.header.Get("Last-Modified") == "" {
+		return // would have to be fetched again every time anyway
+	}
+
+	key := cacheKey(r)
+	vary := varyHeaders(cw.header)
+	if vary != nil {
+		for _, name := range vary {
+			if name == "*" {
+				return
+			}
+		}
+		c.store.Set(key, &cacheEntry{Vary: vary})
+		key = variantKey(key, vary, r)
+	}
+	c.store.Set(key, &cacheEntry{
+		Status: cw.status,
+		Header: cw.header,
+		Body:   cw.body.Bytes(),
+		Date:   responseDate(cw.header, now),
+		Fresh:  fresh,
+		Stale:  stale,
+	})
+}
+
+// freshness works out how long a response may be served from the cache. ok is false
+// when it must not be stored at all.
+func freshness(h http.Header, route *RouteCacheConfig, now time.Time) (fresh, stale time.Duration, ok bool) {
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, 0, false
+	}
+
+	fresh = time.Duration(route.TTL)
+	if seconds, err := strconv.Atoi(cc["s-maxage"]); err == nil {
+		fresh = time.Duration(seconds) * time.Second
+	} else if seconds, err := strconv.Atoi(cc["max-age"]); err == nil {
+		fresh = time.Duration(seconds) * time.Second
+	} else if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		fresh = expires.Sub(now)
+	}
+	if _, ok := cc["no-cache"]; ok || fresh < 0 {
+		fresh = 0
+	}
+
+	stale = time.Duration(route.StaleWhileRevalidate)
+	if seconds, err := strconv.Atoi(cc["stale-while-revalidate"]); err == nil {
+		stale = time.Duration(seconds) * time.Second
+	}
+	_, must := cc["must-revalidate"]
+	_, proxyMust := cc["proxy-revalidate"]
+	if must || proxyMust {
+		stale = 0
+	}
+	return fresh, stale, true
+}
+
+// responseDate is when the upstream generated the response, going by its Age header
+func responseDate(h http.Header, now time.Time) time.Time {
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		return now.Add(-time.Duration(age) * time.Second)
+	}
+	return now
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return cc
+}
+
+// serveEntry writes a stored response, or 304 when the client's copy is still current
+func serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, state string) {
+	h := w.Header()
+	copyHeader(h, e.Header)
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now())/time.Second)))
+	h.Set("X-Cache", state)
+
+	if notModified(r, e.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// copyHeader copies a response header, adding to Vary since the CORS handler already set it
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		if name == "Vary" {
+			for _, v := range values {
+				dst.Add(name, v)
+			}
+			continue
+		}
+		dst[name] = append([]string(nil), values...)
+	}
+}
+
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// captureWriter keeps a copy of the response for the cache while it streams to the client.
+// A 304 to a revalidation is held back, the client gets the refreshed entry instead.
+type captureWriter struct {
+	client   http.ResponseWriter // nil when revalidating in the background
+	hold304  bool
+	limit    int
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool // the body was too large to keep
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) passing() bool {
+	return cw.client != nil && !(cw.hold304 && cw.status == http.StatusNotModified)
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if status < 200 {
+		return // informational responses aren't passed on
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	if !cw.passing() {
+		return
+	}
+	h := cw.client.Header()
+	copyHeader(h, cw.header)
+	h.Set("X-Cache", "MISS")
+	cw.client.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if cw.body.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	if !cw.passing() {
+		return len(b), nil
+	}
+	return cw.client.Write(b)
+}
+
+func (cw *captureWriter) Flush() {
+	if cw.passing() {
+		http.NewResponseController(cw.client).Flush()
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The routing table is read from a JSON file, GATEWAY_CONFIG or gateway.json by default.
+// Everything except the listen addresses can be changed with SIGHUP.
+
+type Config struct {
+	Listen      string                    `json:"listen"`
+	AdminListen string                    `json:"admin_listen"` // empty disables the admin endpoint, see admin.go
+	CORS        CORSConfig                `json:"cors"`
+	Auth        AuthConfig                `json:"auth"`
+	Cache       CacheConfig               `json:"cache"`
+	Upstreams   map[string]UpstreamConfig `json:"upstreams"`
+	Routes      []RouteConfig             `json:"routes"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+type UpstreamConfig struct {
+	Balance        string            `json:"balance"` // "round_robin" (default) or "least_connections"
+	Targets        []string          `json:"targets"`
+	HealthCheck    HealthCheckConfig `json:"health_check"`
+	CircuitBreaker BreakerConfig     `json:"circuit_breaker"`
+	Retries        RetryConfig       `json:"retries"`
+	Concurrency    ConcurrencyConfig `json:"concurrency"`
+	Outlier        OutlierConfig     `json:"outlier_detection"`
+}
+
+type HealthCheckConfig struct {
+	Path               string   `json:"path"` // empty disables active checks
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold"`  // failures in a row that open the breaker
+	OpenFor          Duration `json:"open_for"`           // how long it stays open before probing
+	HalfOpenRequests int      `json:"half_open_requests"` // probes let through at a time
+}
+
+type RetryConfig struct {
+	Attempts int      `json:"attempts"` // tries in total, 1 disables retries
+	Backoff  Duration `json:"backoff"`  // base delay, doubled per retry with full jitter
+}
+
+type ConcurrencyConfig struct {
+	MaxRequests  int      `json:"max_requests"`
+	MaxQueue     *int     `json:"max_queue"` // 256 when left out, 0 sheds whatever finds no free slot
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+type OutlierConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	Ejection            Duration `json:"ejection"`
+	MaxEjectedPercent   int      `json:"max_ejected_percent"`
+}
+
+type RouteConfig struct {
+	Prefix   string            `json:"prefix"`
+	Methods  []string          `json:"methods"` // empty means any method
+	Upstream string            `json:"upstream"`
+	Timeout  Duration          `json:"timeout"` // how long to wait for the response headers, 30s by default
+	Auth     string            `json:"auth"`    // "public" (default), "optional" or "required", see auth.go
+	Cache    *RouteCacheConfig `json:"cache"`   // caches GET responses when set, see cache.go
+}
+
+// Duration reads Go duration strings such as "10s" from JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastConnections = "least_connections"
+)
+
+func configPath() string {
+	if path := os.Getenv("GATEWAY_CONFIG"); path != "" {
+		return path
+	}
+	return "gateway.json"
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the config and fills in defaults
+func (cfg *Config) validate() error {
+	if cfg.Listen == "" {
+		cfg.Listen = ":8080"
+	}
+	switch cfg.Cache.Backend {
+	case "":
+		cfg.Cache.Backend = "memory"
+	case "memory":
+	default:
+		return fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+	}
+	if cfg.Cache.MaxBytes == 0 {
+		cfg.Cache.MaxBytes = defaultCacheBytes
+	}
+	if cfg.Cache.MaxEntryBytes == 0 {
+		cfg.Cache.MaxEntryBytes = defaultCacheEntryBytes
+	}
+	if len(cfg.Upstreams) == 0 {
+		return fmt.Errorf("no upstreams")
+	}
+	for name, up := range cfg.Upstreams {
+		switch up.Balance {
+		case "":
+			up.Balance = balanceRoundRobin
+		case balanceRoundRobin, balanceLeastConnections:
+		default:
+			return fmt.Errorf("upstream %s: unknown balance %q", name, up.Balance)
+		}
+		if len(up.Targets) == 0 {
+			return fmt.Errorf("upstream %s: no targets", name)
+		}
+		for _, target := range up.Targets {
+			u, err := url.Parse(target)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("upstream %s: invalid target %q", name, target)
+			}
+		}
+
+		hc := &up.HealthCheck
+		if hc.Interval == 0 {
+			hc.Interval = Duration(10 * time.Second)
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = Duration(2 * time.Second)
+		}
+		if hc.HealthyThreshold == 0 {
+			hc.HealthyThreshold = 2
+		}
+		if hc.UnhealthyThreshold == 0 {
+			hc.UnhealthyThreshold = 3
+		}
+
+		cb := &up.CircuitBreaker
+		if cb.FailureThreshold == 0 {
+			cb.FailureThreshold = 5
+		}
+		if cb.OpenFor == 0 {
+			cb.OpenFor = Duration(30 * time.Second)
+		}
+		if cb.HalfOpenRequests == 0 {
+			cb.HalfOpenRequests = 1
+		}
+
+		if up.Retries.Attempts == 0 {
+			up.Retries.Attempts = 3
+		}
+		if up.Retries.Backoff == 0 {
+			up.Retries.Backoff = Duration(50 * time.Millisecond)
+		}
+
+		cc := &up.Concurrency
+		if cc.MaxRequests == 0 {
+			cc.MaxRequests = 256
+		}
+		if cc.MaxQueue == nil {
+			queue := 256
+			cc.MaxQueue = &queue
+		}
+		if cc.QueueTimeout == 0 {
+			cc.QueueTimeout = Duration(2 * time.Second)
+		}
+
+		od := &up.Outlier
+		if od.ConsecutiveFailures == 0 {
+			od.ConsecutiveFailures = 5
+		}
+		if od.Ejection == 0 {
+			od.Ejection = Duration(30 * time.Second)
+		}
+		if od.MaxEjectedPercent == 0 {
+			od.MaxEjectedPercent = 50
+		}
+
+		if cb.FailureThreshold < 0 || cb.HalfOpenRequests < 0 || up.Retries.Attempts < 0 ||
+			cc.MaxRequests < 0 || *cc.MaxQueue < 0 || od.ConsecutiveFailures < 0 ||
+			od.MaxEjectedPercent < 0 || od.MaxEjectedPercent > 100 {
+			return fmt.Errorf("upstream %s: limits out of range", name)
+		}
+		cfg.Upstreams[name] = up
+	}
+
+	if len(cfg.Routes) == 0 {
+		return fmt.Errorf("no routes")
+	}
+	for i, route := range cfg.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route %d: prefix must start with /", i)
+		}
+		switch route.Auth {
+		case "":
+			cfg.Routes[i].Auth = authPublic
+		case authPublic:
+		case authOptional, authRequired:
+			if len(identitySecret) == 0 {
+				return fmt.Errorf("route %s: checking tokens needs GATEWAY_IDENTITY_SECRET", route.Prefix)
+			}
+			if cfg.Auth.JWKSURL == "" && os.Getenv("GATEWAY_JWT_SECRET") == "" {
+				return fmt.Errorf("route %s: checking tokens needs auth.jwks_url or GATEWAY_JWT_SECRET", route.Prefix)
+			}
+		default:
+			return fmt.Errorf("route %s: unknown auth %q", route.Prefix, route.Auth)
+		}
+		if _, ok := cfg.Upstreams[route.Upstream]; !ok {
+			return fmt.Errorf("route %s: unknown upstream %q", route.Prefix, route.Upstream)
+		}
+		for j, method := range route.Methods {
+			cfg.Routes[i].Methods[j] = strings.ToUpper(method)
+		}
+	}
+	// Longest prefix wins
+	sort.SliceStable(cfg.Routes, func(i, j int) bool {
+		return len(cfg.Routes[i].Prefix) > len(cfg.Routes[j].Prefix)
+	})
+	return nil
+}
+
+// match finds the route for the request, nil if there is none
+func (cfg *Config) match(r *http.Request) *RouteConfig {
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if !strings.HasPrefix(r.URL.Path, route.Prefix) {
+			continue
+		}
+		if len(route.Methods) == 0 {
+			return route
+		}
+		for _, method := range route.Methods {
+			if method == r.Method {
+				return route
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The gateway tells the API who the client is through Forwarded and X-Forwarded-*.
+// Values a client sends itself are dropped, unless it connects from one of TRUSTED_PROXIES
+// (load balancers in front of the gateway), in which case the chain is extended.
+
+var trustedProxies = loadTrustedProxies()
+
+func loadTrustedProxies() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Invalid trusted proxy %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders writes the forwarding headers of the outgoing request, adding this hop
+// to what a trusted proxy in front of us already recorded
+func setForwardedHeaders(out http.Header, in *http.Request) {
+	peer := in.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	scheme := "http"
+	if in.TLS != nil {
+		scheme = "https"
+	}
+
+	prior := http.Header{}
+	if isTrustedProxy(peer) {
+		prior = in.Header
+	}
+
+	if xff := strings.Join(prior.Values("X-Forwarded-For"), ", "); xff != "" {
+		out.Set("X-Forwarded-For", xff+", "+peer)
+	} else {
+		out.Set("X-Forwarded-For", peer)
+	}
+	if proto := prior.Get("X-Forwarded-Proto"); proto != "" {
+		out.Set("X-Forwarded-Proto", proto)
+	} else {
+		out.Set("X-Forwarded-Proto", scheme)
+	}
+	if host := prior.Get("X-Forwarded-Host"); host != "" {
+		out.Set("X-Forwarded-Host", host)
+	} else {
+		out.Set("X-Forwarded-Host", in.Host)
+	}
+
+	node := peer
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"` // IPv6 has to be quoted and bracketed
+	}
+	element := fmt.Sprintf("for=%s;proto=%s", node, scheme)
+	if in.Host != "" {
+		element += fmt.Sprintf(`;host="%s"`, in.Host)
+	}
+	if fwd := strings.Join(prior.Values("Forwarded"), ", "); fwd != "" {
+		out.Set("Forwarded", fwd+", "+element)
+	} else {
+		out.Set("Forwarded", element)
+	}
+}
@@ -2,7 +2,6 @@ module gateway
 
 go 1.21.6
 
-require (
-	github.com/julienschmidt/httprouter v1.3.0
-	github.com/rs/cors v1.11.1
-)
+require github.com/rs/cors v1.11.1
+
+require github.com/golang-jwt/jwt/v5 v5.2.1
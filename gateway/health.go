@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Active health checks poll every instance of a pool. An instance is taken out after
+// UnhealthyThreshold failed checks in a row and put back after HealthyThreshold good ones.
+
+// checkHealth runs until ctx is cancelled, which happens when the config is reloaded
+func (p *pool) checkHealth(ctx context.Context) {
+	hc := p.Config.HealthCheck
+	if hc.Path == "" {
+		return
+	}
+	client := &http.Client{Timeout: time.Duration(hc.Timeout)}
+
+	for _, inst := range p.Instances {
+		go func(inst *instance) {
+			ticker := time.NewTicker(time.Duration(hc.Interval))
+			defer ticker.Stop()
+			var passes, fails int
+			for {
+				if probe(ctx, client, inst.URL.String()+hc.Path) {
+					passes, fails = passes+1, 0
+				} else {
+					passes, fails = 0, fails+1
+				}
+
+				if !inst.healthy.Load() && passes >= hc.HealthyThreshold {
+					inst.healthy.Store(true)
+					log.Printf("Upstream %s instance %s is healthy", p.Name, inst.URL)
+				} else if inst.healthy.Load() && fails >= hc.UnhealthyThreshold {
+					inst.healthy.Store(false)
+					log.Printf("Upstream %s instance %s is unhealthy", p.Name, inst.URL)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(inst)
+	}
+}
+
+func probe(ctx context.Context, client *http.Client, target string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
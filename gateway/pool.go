@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// A pool is the set of instances behind one named upstream
+
+type instance struct {
+	URL          *url.URL
+	healthy      atomic.Bool
+	active       atomic.Int64 // requests in flight
+	failures     atomic.Int64 // failed requests in a row, for outlier detection
+	ejectedUntil atomic.Int64 // unix nanoseconds, 0 when not ejected
+	proxy        *httputil.ReverseProxy
+}
+
+type pool struct {
+	Name      string
+	Config    UpstreamConfig
+	Instances []*instance
+	breaker   *breaker
+	limiter   *limiter
+	next      atomic.Uint64
+}
+
+// newPool builds a pool, keeping the state of instances that were already in old.
+// The breaker and limiter are kept too unless their settings changed.
+func newPool(name string, cfg UpstreamConfig, old *pool) *pool {
+	known := map[string]*instance{}
+	if old != nil {
+		for _, inst := range old.Instances {
+			known[inst.URL.String()] = inst
+		}
+	}
+
+	p := &pool{Name: name, Config: cfg}
+	for _, target := range cfg.Targets {
+		u, _ := url.Parse(target) // checked by validate
+		inst := &instance{URL: u}
+		inst.proxy = newReverseProxy(inst)
+		inst.healthy.Store(true) // serve right away, the first check corrects it
+		if prev, ok := known[u.String()]; ok {
+			// Without a health check nothing would ever put an unhealthy instance back
+			if cfg.HealthCheck.Path != "" {
+				inst.healthy.Store(prev.healthy.Load())
+			}
+			inst.failures.Store(prev.failures.Load())
+			inst.ejectedUntil.Store(prev.ejectedUntil.Load())
+		}
+		p.Instances = append(p.Instances, inst)
+	}
+
+	if old != nil && old.Config.CircuitBreaker == cfg.CircuitBreaker {
+		p.breaker = old.breaker
+	} else {
+		p.breaker = newBreaker(cfg.CircuitBreaker)
+	}
+	if old != nil && old.Config.Concurrency.same(cfg.Concurrency) {
+		p.limiter = old.limiter
+	} else {
+		p.limiter = newLimiter(cfg.Concurrency)
+	}
+	return p
+}
+
+func (inst *instance) ejected(now time.Time) bool {
+	return inst.ejectedUntil.Load() > now.UnixNano()
+}
+
+func (inst *instance) available(now time.Time) bool {
+	return inst.healthy.Load() && !inst.ejected(now)
+}
+
+// pick chooses a healthy instance, preferring ones not in tried. nil when there is none.
+func (p *pool) pick(tried map[*instance]bool) *instance {
+	if inst := p.choose(tried); inst != nil {
+		return inst
+	}
+	if len(tried) > 0 {
+		return p.choose(nil)
+	}
+	return nil
+}
+
+func (p *pool) choose(skip map[*instance]bool) *instance {
+	now := time.Now()
+	if p.Config.Balance == balanceLeastConnections {
+		var best *instance
+		for _, inst := range p.Instances {
+			if inst.available(now) && !skip[inst] && (best == nil || inst.active.Load() < best.active.Load()) {
+				best = inst
+			}
+		}
+		return best
+	}
+
+	n := uint64(len(p.Instances))
+	start := p.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		inst := p.Instances[(start+i)%n]
+		if inst.available(now) && !skip[inst] {
+			return inst
+		}
+	}
+	return nil
+}
+
+// observe records how a request to inst went. An instance that keeps failing is ejected
+// for a while, but never so many that less than MaxEjectedPercent of the pool is left.
+func (p *pool) observe(inst *instance, ok bool) {
+	p.breaker.record(ok)
+	if ok {
+		inst.failures.Store(0)
+		return
+	}
+
+	od := p.Config.Outlier
+	if inst.failures.Add(1) < int64(od.ConsecutiveFailures) {
+		return
+	}
+	now := time.Now()
+	ejected := 1
+	for _, other := range p.Instances {
+		if other != inst && other.ejected(now) {
+			ejected++
+		}
+	}
+	if ejected*100 > len(p.Instances)*od.MaxEjectedPercent {
+		return
+	}
+	inst.failures.Store(0)
+	inst.ejectedUntil.Store(now.Add(time.Duration(od.Ejection)).UnixNano())
+	log.Printf("Upstream %s instance %s ejected for %s after %d failures", p.Name, inst.URL, time.Duration(od.Ejection), od.ConsecutiveFailures)
+}
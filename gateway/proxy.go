@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The proxy is built on httputil.ReverseProxy, which keeps query strings, drops hop-by-hop
+// headers, tunnels upgrades such as WebSocket, and flushes streamed responses (SSE, unknown
+// length) as they arrive.
+//
+// A request goes through the pool's limiter (upgrades excepted) and circuit breaker first. Connection errors,
+// timeouts and 502/503/504 answers count as failures. Idempotent requests without a body
+// are retried on another instance after a jittered backoff; timeouts are not retried, that
+// would only add to the load on an upstream that is already stalling.
+
+const defaultRouteTimeout = 30 * time.Second
+
+// transport is shared by every instance and survives reloads, so connections stay pooled
+var transport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          256,
+	MaxIdleConnsPerHost:   64,
+	IdleConnTimeout:       90 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+var errRetryStatus = errors.New("retryable status")
+
+type attemptKey struct{}
+
+// attempt is one try at one instance
+type attempt struct {
+	timer    *time.Timer
+	timedOut atomic.Bool
+	last     bool  // only the last try passes a failed response on to the client
+	status   int   // 0 when no response arrived
+	err      error // set when nothing was written to the client
+}
+
+func newReverseProxy(inst *instance) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(inst.URL)
+			setForwardedHeaders(pr.Out.Header, pr.In)
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			at := resp.Request.Context().Value(attemptKey{}).(*attempt)
+			// Headers are in, from here on the response may stream for as long as it likes
+			at.timer.Stop()
+			at.status = resp.StatusCode
+			if failureStatus(resp.StatusCode) && !at.last {
+				return errRetryStatus
+			}
+			// The gateway answers CORS itself, duplicates would make browsers reject the response
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					resp.Header.Del(name)
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// forward decides what to tell the client
+			r.Context().Value(attemptKey{}).(*attempt).err = err
+		},
+	}
+}
+
+func failureStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// retryable is true for requests that can safely be sent twice
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+	default:
+		return false
+	}
+	return (r.Body == nil || r.Body == http.NoBody) && r.Header.Get("Upgrade") == ""
+}
+
+// backoff is full jitter: a random wait up to base doubled for every retry so far
+func backoff(base time.Duration, retry int) time.Duration {
+	limit := base << (retry - 1)
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+func unavailable(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// forward sends the request to the pool, retrying on another instance where that's safe
+func forward(p *pool, route *RouteConfig, w http.ResponseWriter, r *http.Request) {
+	// An upgraded connection would hold its slot for as long as it stays open
+	if r.Header.Get("Upgrade") == "" {
+		release, ok := p.limiter.acquire(r.Context())
+		if !ok {
+			if r.Context().Err() == nil {
+				unavailable(w, time.Second, "Service Unavailable")
+			}
+			return
+		}
+		defer release()
+	}
+
+	tries := 1
+	if retryable(r) {
+		tries = p.Config.Retries.Attempts
+	}
+	tried := map[*instance]bool{}
+	var failed *attempt // the last try, if it failed and the client hasn't been told yet
+
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			timer := time.NewTimer(backoff(time.Duration(p.Config.Retries.Backoff), i))
+			select {
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if !p.breaker.allow() {
+			if failed == nil {
+				unavailable(w, p.breaker.retryAfter(), "Service Unavailable")
+				return
+			}
+			break
+		}
+		inst := p.pick(tried)
+		if inst == nil {
+			p.breaker.cancel()
+			if failed == nil {
+				log.Printf("No healthy instance in upstream %s for %s %s", p.Name, r.Method, r.URL.Path)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			break
+		}
+		tried[inst] = true
+
+		at := &attempt{last: i == tries-1}
+		if gone := try(p, inst, route, at, w, r); gone {
+			return // the client went away
+		}
+		if at.err == nil {
+			return // answered, well or not
+		}
+
+		failed = at
+		if at.timedOut.Load() {
+			log.Printf("Upstream %s timed out on %s %s", inst.URL, r.Method, r.URL.Path)
+			break
+		}
+		if errors.Is(at.err, errRetryStatus) {
+			log.Printf("Upstream %s answered %d to %s %s", inst.URL, at.status, r.Method, r.URL.Path)
+		} else {
+			log.Printf("Error proxying %s %s to %s: %v", r.Method, r.URL.Path, inst.URL, at.err)
+		}
+	}
+
+	switch {
+	case failed.timedOut.Load():
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+	case failed.status != 0:
+		http.Error(w, http.StatusText(failed.status), failed.status)
+	default:
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+}
+
+// try makes one attempt and settles it with the instance and the breaker, reporting whether the
+// client went away. ReverseProxy panics with http.ErrAbortHandler when a copy fails mid-body;
+// the attempt is still settled before the panic carries on up.
+func try(p *pool, inst *instance, route *RouteConfig, at *attempt, w http.ResponseWriter, r *http.Request) (gone bool) {
+	inst.active.Add(1)
+	defer inst.active.Add(-1)
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if r.Context().Err() != nil {
+			p.breaker.cancel()
+		} else {
+			p.observe(inst, false)
+		}
+		panic(v)
+	}()
+
+	send(inst, route, at, w, r)
+	if at.err != nil && r.Context().Err() != nil {
+		p.breaker.cancel()
+		return true
+	}
+	p.observe(inst, at.err == nil && !failureStatus(at.status))
+	return false
+}
+
+// send makes one attempt. The route timeout covers waiting for the response headers only,
+// so long polls, downloads, SSE and WebSockets aren't cut off.
+func send(inst *instance, route *RouteConfig, at *attempt, w http.ResponseWriter, r *http.Request) {
+	timeout := time.Duration(route.Timeout)
+	if timeout == 0 {
+		timeout = defaultRouteTimeout
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	at.timer = time.AfterFunc(timeout, func() {
+		at.timedOut.Store(true)
+		cancel()
+	})
+	defer at.timer.Stop()
+
+	inst.proxy.ServeHTTP(w, r.WithContext(context.WithValue(ctx, attemptKey{}, at)))
+}
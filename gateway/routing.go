@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/cors"
+)
+
+// routing is one loaded config with its pools. Reloading builds a new one and swaps it in;
+// requests already running keep the one they started with, so nothing is dropped.
+type routing struct {
+	cfg    *Config
+	pools  map[string]*pool
+	auth   *verifier
+	cors   *cors.Cors
+	cache  *edgeCache
+	cancel context.CancelFunc // stops the health checks
+}
+
+var (
+	current  atomic.Pointer[routing]
+	reloadMu sync.Mutex
+)
+
+func newRouting(cfg *Config, old *routing) *routing {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := &routing{
+		cfg:   cfg,
+		pools: map[string]*pool{},
+		cors: cors.New(cors.Options{
+			AllowedOrigins:   cfg.CORS.AllowedOrigins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: true,
+		}),
+		auth:   newVerifier(cfg.Auth),
+		cancel: cancel,
+	}
+	// Cached responses survive reloads unless the cache itself was reconfigured
+	if old != nil && old.cfg.Cache == cfg.Cache {
+		rt.cache = old.cache
+	} else {
+		rt.cache = newEdgeCache(cfg.Cache)
+	}
+	for name, upCfg := range cfg.Upstreams {
+		var prev *pool
+		if old != nil {
+			prev = old.pools[name]
+		}
+		p := newPool(name, upCfg, prev)
+		rt.pools[name] = p
+		p.checkHealth(ctx)
+	}
+	return rt
+}
+
+// reload reads the config file again. A broken file leaves the running config in place.
+func reload(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	old := current.Load()
+	if old != nil && cfg.Listen != old.cfg.Listen {
+		log.Printf("Listen address changes need a restart, staying on %s", old.cfg.Listen)
+		cfg.Listen = old.cfg.Listen
+	}
+	if old != nil && cfg.AdminListen != old.cfg.AdminListen {
+		log.Printf("Admin address changes need a restart, staying on %q", old.cfg.AdminListen)
+		cfg.AdminListen = old.cfg.AdminListen
+	}
+	current.Store(newRouting(cfg, old))
+	if old != nil {
+		old.cancel()
+	}
+	log.Printf("Loaded %d routes and %d upstreams from %s", len(cfg.Routes), len(cfg.Upstreams), path)
+	return nil
+}
+
+// gatewayHandler routes every request with whatever config is current
+func gatewayHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := current.Load()
+		rt.cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := rt.cfg.match(r)
+			if route == nil {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
+			if !rt.auth.authenticate(route.Auth, w, r) {
+				return
+			}
+			p := rt.pools[route.Upstream]
+			if route.Cache != nil && cacheable(r) {
+				rt.cache.serve(p, route, w, r)
+				return
+			}
+			forward(p, route, w, r)
+		})).ServeHTTP(w, r)
+	})
+}
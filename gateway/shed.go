@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Each upstream takes at most MaxRequests at a time. Requests beyond that wait in a queue of
+// MaxQueue for up to QueueTimeout; anything more is shed with a quick 503 rather than
+// adding to the backlog of a slow backend. Upgraded connections (WebSocket) can stay open for
+// hours and aren't counted, see forward.
+
+type limiter struct {
+	cfg     ConcurrencyConfig
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+// same is true when both configs build the same limiter. MaxQueue is set once loaded.
+func (c ConcurrencyConfig) same(o ConcurrencyConfig) bool {
+	return c.MaxRequests == o.MaxRequests && *c.MaxQueue == *o.MaxQueue && c.QueueTimeout == o.QueueTimeout
+}
+
+func newLimiter(cfg ConcurrencyConfig) *limiter {
+	return &limiter{cfg: cfg, slots: make(chan struct{}, cfg.MaxRequests)}
+}
+
+// acquire takes a slot, false means the request should be shed. Call release when done.
+func (l *limiter) acquire(ctx context.Context) (release func(), ok bool) {
+	release = func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	if l.waiting.Add(1) > int64(*l.cfg.MaxQueue) {
+		l.waiting.Add(-1)
+		return nil, false
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(time.Duration(l.cfg.QueueTimeout))
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+type limiterStatus struct {
+	InFlight int   `json:"in_flight"`
+	Queued   int64 `json:"queued"`
+}
+
+func (l *limiter) status() limiterStatus {
+	return limiterStatus{InFlight: len(l.slots), Queued: l.waiting.Load()}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+// signingKey is one entry of the key ring. Keys without private material can only verify.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+}
+
+type keyRing struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var jwtKeys *keyRing
+
+const minHS256SecretLen = 32
+
+// loadSigningKeys reads the key ring from the environment.
+//
+//	JWT_KEYS       comma separated kid:alg:path entries, alg is HS256, RS256 or EdDSA.
+//	               HS256 files hold the raw secret, the others a PEM private or public key.
+//	JWT_ACTIVE_KID kid of the key used to sign new tokens
+//	JWT_SECRET     fallback HS256 secret (kid "default") when JWT_KEYS is not set
+//
+// Rotating means adding the new key, switching JWT_ACTIVE_KID and dropping the old key
+// once the tokens it signed have expired.
+func loadSigningKeys() error {
+	ring := &keyRing{keys: make(map[string]*signingKey)}
+
+	spec := os.Getenv("JWT_KEYS")
+	if spec == "" {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return errors.New("neither JWT_KEYS nor JWT_SECRET is set")
+		}
+		if len(secret) < minHS256SecretLen {
+			return fmt.Errorf("JWT_SECRET must be at least %d bytes", minHS256SecretLen)
+		}
+		key := &signingKey{ID: "default", Method: jwt.SigningMethodHS256, Private: []byte(secret), Public: []byte(secret)}
+		ring.keys[key.ID] = key
+		ring.active = key
+		jwtKeys = ring
+		return nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid JWT_KEYS entry %q, expected kid:alg:path", entry)
+		}
+		key, err := loadSigningKey(parts[0], parts[1], parts[2])
+		if err != nil {
+			return fmt.Errorf("key %s: %w", parts[0], err)
+		}
+		if _, exists := ring.keys[key.ID]; exists {
+			return fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KID")
+	active, ok := ring.keys[activeID]
+	if !ok {
+		return fmt.Errorf("JWT_ACTIVE_KID %q is not in JWT_KEYS", activeID)
+	}
+	if active.Private == nil {
+		return fmt.Errorf("active key %s has no private key", activeID)
+	}
+	ring.active = active
+
+	jwtKeys = ring
+	return nil
+}
+
+func loadSigningKey(kid, alg, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{ID: kid}
+	isPrivate := strings.Contains(string(data), "PRIVATE KEY")
+
+	switch alg {
+	case "HS256":
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) < minHS256SecretLen {
+			return nil, fmt.Errorf("HS256 secret must be at least %d bytes", minHS256SecretLen)
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.Private = secret
+		key.Public = secret
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if isPrivate {
+			priv, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.Private = priv
+			key.Public = &priv.PublicKey
+		} else {
+			pub, err := jwt.ParseRSAPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.Public = pub
+		}
+	case "EdDSA":
+		key.Method = jwt.SigningMethodEdDSA
+		if isPrivate {
+			priv, err := jwt.ParseEdPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.Private = priv
+			key.Public = priv.(crypto.Signer).Public()
+		} else {
+			pub, err := jwt.ParseEdPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.Public = pub
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	return key, nil
+}
+
+// sign signs the claims with the active key and stamps its kid into the header
+func (k *keyRing) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.Method, claims)
+	token.Header["kid"] = k.active.ID
+	return token.SignedString(k.active.Private)
+}
+
+// keyFunc picks the verification key by kid and refuses tokens signed with another algorithm
+func (k *keyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+func (k *keyRing) algorithms() []string {
+	seen := map[string]bool{}
+	var algs []string
+	for _, key := range k.keys {
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// JWK is a single public key as published in the JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwks serves the public halves of the asymmetric keys. HMAC secrets are never published.
+func jwks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	keys := []JWK{}
+	for _, key := range jwtKeys.keys {
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	sendJSONResponse(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// Failed logins are counted per username and per client. A few failures add a growing
+// delay before the next attempt, more of them lock the username or client out for a while.
+const (
+	loginFailureWindow = 15 * time.Minute
+	loginDelayAfter    = 3 // failures before delays kick in
+	maxLoginDelay      = 30 * time.Second
+
+	maxUserLoginFailures   = 5
+	maxClientLoginFailures = 20 // clients can be shared (NAT, offices), so they get more room
+	loginLockout           = 15 * time.Minute
+)
+
+type loginScope struct {
+	name  string
+	id    string
+	limit int64
+}
+
+func loginScopes(username, ip string) []loginScope {
+	return []loginScope{
+		{name: "user", id: strings.ToLower(strings.TrimSpace(username)), limit: maxUserLoginFailures},
+		{name: "client", id: ip, limit: maxClientLoginFailures},
+	}
+}
+
+func loginFailKey(scope loginScope) string {
+	return "login:fail:" + scope.name + ":" + scope.id
+}
+
+func loginLockKey(scope loginScope) string {
+	return "login:lock:" + scope.name + ":" + scope.id
+}
+
+// loginRetryAfter returns how long the username or client still has to wait, zero if it may try now.
+// Redis errors let the attempt through rather than locking everybody out, unless
+// REDIS_FAIL_RATELIMIT is closed.
+func loginRetryAfter(username, ip string) time.Duration {
+	var wait time.Duration
+	for _, scope := range loginScopes(username, ip) {
+		ttl, err := RdxTTL(loginLockKey(scope))
+		if err != nil {
+			log.Printf("Error checking login lock: %v", err)
+			if rateLimitFailPolicy == failClosed {
+				return redisProbeInterval
+			}
+			continue
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed attempt and sets the delay or lockout it earns
+func recordLoginFailure(username, ip string) {
+	for _, scope := range loginScopes(username, ip) {
+		failures, err := RdxIncr(loginFailKey(scope), loginFailureWindow)
+		if err != nil {
+			log.Printf("Error recording login failure: %v", err)
+			continue
+		}
+
+		var wait time.Duration
+		if failures >= scope.limit {
+			wait = loginLockout
+			log.Printf("Login locked for %s %s after %d failures", scope.name, scope.id, failures)
+		} else if failures >= loginDelayAfter {
+			wait = time.Second << (failures - loginDelayAfter)
+			if wait > maxLoginDelay {
+				wait = maxLoginDelay
+			}
+		}
+		if wait > 0 {
+			if err := RdxSetEx(loginLockKey(scope), "1", wait); err != nil {
+				log.Printf("Error setting login lock: %v", err)
+			}
+		}
+	}
+}
+
+// clearLoginFailures unlocks usernames (or emails) after a successful login or a password reset.
+// The client counter is left to expire so one good account can't reset it.
+func clearLoginFailures(identifiers ...string) {
+	for _, identifier := range identifiers {
+		scope := loginScopes(identifier, "")[0]
+		RdxDel(loginFailKey(scope))
+		RdxDel(loginLockKey(scope))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// useMiniredis points conn at an in-process Redis for the duration of the test
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	prev := conn
+	conn = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		conn.Close()
+		conn = prev
+	})
+	return mr
+}
+
+func TestLoginLockout(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("wrong passwords", func(mt *mtest.T) {
+		mr := useMiniredis(t)
+		useMockUsers(mt)
+		wrong := `{"username":"alice","password":"battery staple"}`
+
+		for i := 1; i <= maxUserLoginFailures; i++ {
+			// Sit out the growing delays, only the lockout is left at the end
+			mr.FastForward(maxLoginDelay)
+			mt.AddMockResponses(storedUserResponse(t, mt, "alice", "correct horse"))
+			if rec := postLogin(wrong); rec.Code != http.StatusUnauthorized {
+				t.Fatalf("attempt %d: got %d %q, want 401", i, rec.Code, rec.Body.String())
+			}
+			if i == loginDelayAfter {
+				rec := postLogin(wrong)
+				if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+					t.Fatalf("right after %d failures: got %d, Retry-After %q, want a 1s delay", i, rec.Code, rec.Header().Get("Retry-After"))
+				}
+			}
+		}
+
+		mr.FastForward(maxLoginDelay)
+		rec := postLogin(`{"username":"alice","password":"correct horse"}`)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("after %d failures: got %d %q, want 429", maxUserLoginFailures, rec.Code, rec.Body.String())
+		}
+		if got, want := rec.Header().Get("Retry-After"), "870"; got != want {
+			t.Fatalf("Retry-After is %q, want %q", got, want)
+		}
+
+		// Another account from the same client isn't locked out
+		mt.AddMockResponses(storedUserResponse(t, mt, "bob", "correct horse"))
+		if rec := postLogin(`{"username":"bob","password":"wrong"}`); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("other account: got %d %q, want 401", rec.Code, rec.Body.String())
+		}
+	})
+}
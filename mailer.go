@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+var mailer Mailer
+
+// loadMailer picks the mailer from MAILER, "smtp" or "log". There is no default: the log
+// mailer prints single-use tokens, so it has to be asked for.
+func loadMailer() error {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		if os.Getenv("SMTP_HOST") == "" || os.Getenv("SMTP_PORT") == "" {
+			return fmt.Errorf("MAILER=smtp needs SMTP_HOST and SMTP_PORT")
+		}
+		mailer = &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "log":
+		mailer = &LogMailer{Dir: os.Getenv("MAIL_DIR"), From: from}
+	case "":
+		return fmt.Errorf("MAILER is not set, use smtp, or log for local development")
+	default:
+		return fmt.Errorf("unknown MAILER %q, use smtp or log", os.Getenv("MAILER"))
+	}
+	return nil
+}
+
+// SMTPMailer delivers mail through an SMTP relay
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	msg := buildMessage(m.From, to, subject, body)
+	if err := smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, msg); err != nil {
+		return fmt.Errorf("error sending mail to %s: %w", to, err)
+	}
+	return nil
+}
+
+// LogMailer writes every message to Dir as an .eml file, or to the log when Dir is empty.
+// Meant for local development and tests.
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	msg := buildMessage(m.From, to, subject, body)
+	if m.Dir == "" {
+		log.Printf("Mail to %s:\n%s", to, msg)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating mail directory: %w", err)
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(to))
+	return os.WriteFile(filepath.Join(m.Dir, name), msg, 0644)
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + to + "\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestLoadMailer(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "unset", env: map[string]string{"MAILER": ""}, wantErr: true},
+		{name: "unknown", env: map[string]string{"MAILER": "sendmail"}, wantErr: true},
+		{name: "smtp without a host", env: map[string]string{"MAILER": "smtp", "SMTP_HOST": "", "SMTP_PORT": "25"}, wantErr: true},
+		{name: "smtp", env: map[string]string{"MAILER": "smtp", "SMTP_HOST": "mail.example.com", "SMTP_PORT": "587"}},
+		{name: "log", env: map[string]string{"MAILER": "log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := mailer
+			t.Cleanup(func() { mailer = prev })
+			mailer = nil
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			err := loadMailer()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if err == nil && mailer == nil {
+				t.Fatal("no mailer was set")
+			}
+		})
+	}
+}
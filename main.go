@@ -9,7 +9,6 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
 	"go.mongodb.org/mongo-driver/bson"
@@ -18,9 +17,21 @@ import (
 )
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	// .env is loaded in init, see rdx.go
+	if err := loadSigningKeys(); err != nil {
+		log.Fatalf("Error loading JWT signing keys: %v", err)
+	}
+	if err := loadMailer(); err != nil {
+		log.Fatalf("Error configuring the mailer: %v", err)
+	}
+	if err := loadOIDCProviders(); err != nil {
+		log.Fatalf("Error loading OIDC providers: %v", err)
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatalf("Error loading trusted proxies: %v", err)
+	}
+	if err := loadRedisPolicies(); err != nil {
+		log.Fatalf("Error loading Redis failure policies: %v", err)
 	}
 
 	// Get the MongoDB URI from the environment variable
@@ -34,7 +45,8 @@ func main() {
 	opts := options.Client().ApplyURI(mongoURI).SetServerAPIOptions(serverAPI)
 
 	// Create a new client and connect to the server
-	client, err := mongo.Connect(context.TODO(), opts)
+	var err error
+	client, err = mongo.Connect(context.TODO(), opts)
 	if err != nil {
 		panic(err)
 	}
@@ -52,6 +64,19 @@ func main() {
 	fmt.Println("Pinged your deployment. You successfully connected to MongoDB!")
 	userCollection = client.Database("eventdb").Collection("users")
 
+	// naevis reindex-places rebuilds the place autocomplete index and exits
+	if len(os.Args) > 1 && os.Args[1] == "reindex-places" {
+		count, err := rebuildPlaceIndex(context.Background())
+		if err != nil {
+			log.Fatalf("Error rebuilding place index after %d places: %v", count, err)
+		}
+		log.Printf("Indexed %d places", count)
+		return
+	}
+	startErasureWorker()
+	startExportWorker()
+	startRedisMonitor()
+
 	router := httprouter.New()
 	router.GET("/", Index)
 	router.GET("/about", Index)
@@ -66,102 +91,132 @@ func main() {
 	router.GET("/events", Index)
 	router.GET("/feed", Index)
 	router.GET("/api/sda", GetAds)
+	router.GET("/api/health", getHealth)
 	router.GET("/user/:username", Index)
 	router.GET("/event/:eventid", Index)
 	router.GET("/place/:placeid", Index)
 
 	router.GET("/api/settings", GetSettings)
 	router.GET("/api/settings/:type", GetSetting)
-	router.PUT("/api/settings/:type", UpdateSettings)
-	router.DELETE("/api/settings/:type", DeleteSettings)
+	router.PUT("/api/settings/:type", authenticate(rateLimit(writeLimit, requireRole(roleAdmin, UpdateSettings))))
+	router.DELETE("/api/settings/:type", authenticate(rateLimit(writeLimit, requireRole(roleAdmin, DeleteSettings))))
 
 	router.GET("/favicon.ico", Favicon)
 
-	router.POST("/api/register", rateLimit(register))
-	router.POST("/api/login", rateLimit(login))
-	router.POST("/api/logout", authenticate(logoutUser))
-	router.GET("/api/profile", authenticate(getProfile))
-	router.PUT("/api/profile", authenticate(editProfile))
-	router.PUT("/api/profile/dp", authenticate(editProfilePic))
-	router.PUT("/api/profile/banner", authenticate(editProfileBanner))
-	router.DELETE("/api/profile", authenticate(deleteProfile))
-	router.POST("/api/follows/:id", authenticate(toggleFollow))
+	router.POST("/api/register", rateLimit(authLimit, register))
+	router.POST("/api/login", rateLimit(authLimit, login))
+	router.POST("/api/login/2fa", rateLimit(authLimit, loginSecondFactor))
+	router.POST("/api/2fa/enroll", authenticate(rateLimit(writeLimit, enrollTOTP)))
+	router.POST("/api/2fa/confirm", authenticate(rateLimit(authLimit, confirmTOTP)))
+	router.POST("/api/2fa/disable", authenticate(rateLimit(authLimit, disableTOTP)))
+	router.POST("/api/logout", authenticate(rateLimit(writeLimit, logoutUser)))
+	router.GET("/api/profile", requireScope("profile:read", authenticate(getProfile)))
+	router.PUT("/api/profile", authenticate(rateLimit(writeLimit, editProfile)))
+	router.PUT("/api/profile/dp", authenticate(rateLimit(uploadLimit, editProfilePic)))
+	router.PUT("/api/profile/banner", authenticate(rateLimit(uploadLimit, editProfileBanner)))
+	router.DELETE("/api/profile", authenticate(rateLimit(writeLimit, deleteProfile)))
+	router.GET("/api/profile/deletion", authenticate(getProfileDeletion))
+	router.POST("/api/profile/deletion/cancel", authenticate(rateLimit(writeLimit, cancelProfileDeletion)))
+	router.POST("/api/profile/export", authenticate(rateLimit(writeLimit, requestExport)))
+	router.GET("/api/profile/export/:id", authenticate(getExport))
+	router.GET("/api/profile/export/:id/download", downloadExport)
+	router.POST("/api/follows/:id", authenticate(rateLimit(writeLimit, toggleFollow)))
 	router.GET("/api/follows/:id", authenticate(doesFollow))
 	router.GET("/api/followers", authenticate(getFollowers))
 	router.GET("/api/following", authenticate(getFollowing))
 	router.GET("/api/follow/suggestions", authenticate(suggestFollowers))
-	router.POST("/api/activity", authenticate(logActivity))
+	router.POST("/api/activity", authenticate(rateLimit(writeLimit, logActivity)))
 	router.GET("/api/activity", authenticate(getActivityFeed))
 	router.GET("/api/user/:username", getUserProfile)
-	router.POST("/api/token/refresh", rateLimit(authenticate(refreshToken)))
+	router.POST("/api/token/refresh", rateLimit(authLimit, refreshToken))
+	router.GET("/api/sessions", authenticate(getSessions))
+	router.DELETE("/api/sessions/:id", authenticate(rateLimit(writeLimit, deleteSession)))
+	router.POST("/api/sessions/logout-others", authenticate(rateLimit(writeLimit, logoutOtherSessions)))
+	router.GET("/api/tokens", authenticate(getAccessTokens))
+	router.GET("/api/tokens/scopes", getAccessTokenScopes)
+	router.POST("/api/tokens", authenticate(rateLimit(writeLimit, createAccessToken)))
+	router.DELETE("/api/tokens/:id", authenticate(rateLimit(writeLimit, deleteAccessToken)))
+	router.GET("/.well-known/jwks.json", jwks)
+	router.POST("/api/email/verify", rateLimit(authLimit, verifyEmail))
+	router.POST("/api/email/verify/resend", authenticate(rateLimit(authLimit, resendVerification)))
+	router.GET("/verify", Index)
+	router.POST("/api/password/forgot", rateLimit(authLimit, forgotPassword))
+	router.POST("/api/password/reset", rateLimit(authLimit, resetPassword))
+	router.GET("/api/auth/oidc/:provider/start", rateLimit(authLimit, oidcStart))
+	router.GET("/api/auth/oidc/:provider/callback", rateLimit(authLimit, oidcCallback))
+	router.POST("/api/auth/oidc/:provider/link", authenticate(rateLimit(authLimit, oidcLink)))
+	router.GET("/reset-password", Index)
+	router.PUT("/api/admin/users/:userid/role", authenticate(rateLimit(writeLimit, requireRole(roleAdmin, setUserRole))))
+	router.GET("/api/admin/deletions/:id", authenticate(requireRole(roleAdmin, getDeletionJob)))
 
 	router.GET("/api/events", getEvents)
-	router.GET("/api/search", searchEvents)
-	router.POST("/api/event", authenticate(createEvent))
+	router.GET("/api/search", rateLimit(searchLimit, searchEvents))
+	router.POST("/api/event", requireScope("events:write", authenticate(rateLimit(writeLimit, requireRole(roleUser, requireVerified(createEvent))))))
 	router.GET("/api/event/:eventid", getEvent)
-	router.PUT("/api/event/:eventid", authenticate(editEvent))
-	router.DELETE("/api/event/:eventid", authenticate(deleteEvent))
+	router.PUT("/api/event/:eventid", requireScope("events:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, editEvent)))))
+	router.DELETE("/api/event/:eventid", requireScope("events:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, deleteEvent)))))
 
 	// router.POST("/api/event/:eventid/review", authenticate(addReview))
 
-	router.POST("/api/media/:entitytype/:entityid", authenticate(addMedia))
+	router.POST("/api/media/:entitytype/:entityid", requireScope("media:write", authenticate(rateLimit(uploadLimit, requireOwner(entityOwner, roleAdmin, addMedia)))))
 	router.GET("/api/media/:entitytype/:entityid/:id", getMedia)
-	router.PUT("/api/media/:entitytype/:entityid/:id", editMedia)
+	router.PUT("/api/media/:entitytype/:entityid/:id", requireScope("media:write", authenticate(rateLimit(writeLimit, requireOwner(mediaOwner, roleModerator, editMedia)))))
 	router.GET("/api/media/:entitytype/:entityid", getMedias)
-	router.DELETE("/api/media/:entitytype/:entityid/:id", authenticate(deleteMedia))
-
-	router.POST("/api/event/:eventid/merch", authenticate(createMerch))
-	router.POST("/api/event/:eventid/merch/:merchid/buy", authenticate(buyMerch))
-	router.GET("/api/event/:eventid/merch", getMerchs)
-	router.GET("/api/event/:eventid/merch/:merchid", getMerch)
-	router.PUT("/api/event/:eventid/merch/:merchid", authenticate(editMerch))
-	router.DELETE("/api/event/:eventid/merch/:merchid", authenticate(deleteMerch))
-
-	router.POST("/api/event/:eventid/ticket", authenticate(createTicket))
-	router.GET("/api/event/:eventid/ticket", getTickets)
-	router.GET("/api/event/:eventid/ticket/:ticketid", getTicket)
-	router.POST("/api/event/:eventid/tickets/:ticketid/buy", authenticate(buyTicket))
-	router.PUT("/api/event/:eventid/ticket/:ticketid", authenticate(editTicket))
-	router.DELETE("/api/event/:eventid/ticket/:ticketid", authenticate(deleteTicket))
-	router.POST("/api/book-seats", bookSeats)
-
-	router.GET("/api/feed", authenticate(getPosts))
-	router.POST("/api/post", authenticate(createTweetPost))
-	router.PUT("/api/post/:id", authenticate(editPost))
-	router.DELETE("/api/post/:id", authenticate(deletePost))
-
-	router.GET("/api/suggestions/places", suggestionsHandler)
+	router.DELETE("/api/media/:entitytype/:entityid/:id", requireScope("media:write", authenticate(rateLimit(writeLimit, requireOwner(mediaOwner, roleModerator, deleteMedia)))))
+
+	router.POST("/api/event/:eventid/merch", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, createMerch)))))
+	router.POST("/api/event/:eventid/merch/:merchid/buy", authenticate(rateLimit(writeLimit, buyMerch)))
+	router.GET("/api/event/:eventid/merch", noStore(getMerchs))
+	router.GET("/api/event/:eventid/merch/:merchid", noStore(getMerch))
+	router.PUT("/api/event/:eventid/merch/:merchid", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, editMerch)))))
+	router.DELETE("/api/event/:eventid/merch/:merchid", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, deleteMerch)))))
+
+	router.POST("/api/event/:eventid/ticket", requireScope("tickets:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, createTicket)))))
+	router.GET("/api/event/:eventid/ticket", noStore(requireScope("tickets:read", authenticateOptional(getTickets))))
+	router.GET("/api/event/:eventid/ticket/:ticketid", noStore(requireScope("tickets:read", authenticateOptional(getTicket))))
+	router.POST("/api/event/:eventid/tickets/:ticketid/buy", authenticate(rateLimit(writeLimit, buyTicket)))
+	router.PUT("/api/event/:eventid/ticket/:ticketid", requireScope("tickets:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, editTicket)))))
+	router.DELETE("/api/event/:eventid/ticket/:ticketid", requireScope("tickets:write", authenticate(rateLimit(writeLimit, requireOwner(eventOwner, roleAdmin, deleteTicket)))))
+	router.POST("/api/book-seats", authenticate(rateLimit(writeLimit, bookSeats)))
+
+	router.GET("/api/feed", requireScope("posts:read", authenticate(getPosts)))
+	router.POST("/api/post", requireScope("posts:write", authenticate(rateLimit(uploadLimit, requireVerified(createTweetPost)))))
+	router.PUT("/api/post/:id", requireScope("posts:write", authenticate(rateLimit(writeLimit, requireOwner(postOwner, roleModerator, editPost)))))
+	router.DELETE("/api/post/:id", requireScope("posts:write", authenticate(rateLimit(writeLimit, requireOwner(postOwner, roleModerator, deletePost)))))
+
+	router.GET("/api/suggestions/places", rateLimit(searchLimit, suggestionsHandler))
 	router.GET("/api/places", getPlaces)
-	router.POST("/api/place", authenticate(createPlace))
+	router.POST("/api/place", requireScope("places:write", authenticate(rateLimit(writeLimit, requireVerified(createPlace)))))
 	router.GET("/api/place/:placeid", getPlace)
-	router.PUT("/api/place/:placeid", authenticate(editPlace))
-	router.DELETE("/api/place/:placeid", authenticate(deletePlace))
+	router.PUT("/api/place/:placeid", requireScope("places:write", authenticate(rateLimit(writeLimit, requireOwner(placeOwner, roleAdmin, editPlace)))))
+	router.DELETE("/api/place/:placeid", requireScope("places:write", authenticate(rateLimit(writeLimit, requireOwner(placeOwner, roleAdmin, deletePlace)))))
 	// router.DELETE("/api/place/:placeid/review", authenticate(addReview))
 
-	router.POST("/api/place/:placeid/merch", authenticate(createMerch))
-	router.GET("/api/place/:placeid/merch/:merchid", getMerch)
-	router.PUT("/api/place/:placeid/merch/:merchid", authenticate(editMerch))
-	router.DELETE("/api/place/:placeid/merch/:merchid", authenticate(deleteMerch))
+	router.POST("/api/place/:placeid/merch", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(placeOwner, roleAdmin, createMerch)))))
+	router.GET("/api/place/:placeid/merch/:merchid", noStore(getMerch))
+	router.PUT("/api/place/:placeid/merch/:merchid", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(placeOwner, roleAdmin, editMerch)))))
+	router.DELETE("/api/place/:placeid/merch/:merchid", requireScope("merch:write", authenticate(rateLimit(writeLimit, requireOwner(placeOwner, roleAdmin, deleteMerch)))))
 
 	router.GET("/businesses", GetBusinesses)
-	router.POST("/business", AddBusinessHandler)
+	router.POST("/business", authenticate(rateLimit(writeLimit, requireRole(roleAdmin, AddBusinessHandler))))
 	router.GET("/business/:id", GetBusinessHandler)
-	router.POST("/business/:id/book", BookSlotHandler)
+	router.POST("/business/:id/book", authenticate(rateLimit(writeLimit, BookSlotHandler)))
 	router.GET("/business/:id/menu", GetMenuHandler)
 	router.GET("/business/:id/promotions", GetPromotionsHandler)
 
 	// Define business-side routes
-	router.POST("/owner/register", RegisterOwnerHandler)
-	router.POST("/owner/login", LoginOwnerHandler)
-	router.POST("/owner/business", AddBusinessByOwnerHandler)
-	router.PUT("/owner/business/:id", UpdateBusinessHandler)
-	router.DELETE("/owner/business/:id", DeleteBusinessHandler)
-	router.POST("/owner/business/:id/menu", AddOrUpdateMenuHandler)
-	router.DELETE("/owner/business/:id/menu/:itemId", DeleteMenuItemHandler)
-	router.POST("/owner/business/:id/promotions", AddPromotionHandler)
-	router.DELETE("/owner/business/:id/promotions/:promoId", DeletePromotionHandler)
-	router.GET("/owner/business/:id/bookings", ViewBookingsHandler)
-	router.DELETE("/owner/business/:id/bookings/:bookingId", CancelBookingHandler)
+	router.POST("/owner/register", rateLimit(authLimit, RegisterOwnerHandler))
+	router.POST("/owner/login", rateLimit(authLimit, login))
+	router.GET("/owner/businesses", authenticate(requireRole(roleOwner, GetOwnedBusinessesHandler)))
+	router.POST("/owner/business", authenticate(rateLimit(writeLimit, requireRole(roleOwner, AddBusinessByOwnerHandler))))
+	router.PUT("/owner/business/:id", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, UpdateBusinessHandler))))
+	router.DELETE("/owner/business/:id", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, DeleteBusinessHandler))))
+	router.POST("/owner/business/:id/menu", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, AddOrUpdateMenuHandler))))
+	router.DELETE("/owner/business/:id/menu/:itemId", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, DeleteMenuItemHandler))))
+	router.POST("/owner/business/:id/promotions", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, AddPromotionHandler))))
+	router.DELETE("/owner/business/:id/promotions/:promoId", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, DeletePromotionHandler))))
+	router.GET("/owner/business/:id/bookings", authenticate(requireOwner(businessOwners, roleAdmin, ViewBookingsHandler)))
+	router.DELETE("/owner/business/:id/bookings/:bookingId", authenticate(rateLimit(writeLimit, requireOwner(businessOwners, roleAdmin, CancelBookingHandler))))
 
 	// CORS setup
 	allowedOrigin := os.Getenv("ALLOWED_ORIGIN")
@@ -187,7 +242,7 @@ func main() {
 	router.ServeFiles("/postpic/*filepath", http.Dir("postpic"))
 	// http.ListenAndServe("localhost:4000", router)
 
-	handler := securityHeaders(c.Handler(router))
+	handler := securityHeaders(withClientInfo(c.Handler(router)))
 
 	server := &http.Server{
 		Addr:    ":4000",
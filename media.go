@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -114,6 +113,7 @@ func addMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		http.Error(w, "Error saving media to database: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), entityTag(entityType, entityID))
 
 	// Respond with the created media object
 	w.Header().Set("Content-Type", "application/json")
@@ -129,29 +129,13 @@ func getMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	entityType := ps.ByName("entitytype")
 	entityID := ps.ByName("entityid")
 	mediaID := ps.ByName("id")
-	// cacheKey := fmt.Sprintf("media:%s:%s", entityID, mediaID)
 
-	// // Check the cache first
-	// cachedMedia, err := RdxGet(cacheKey) // Assuming RdxGet is a function to get cached data
-	// if err == nil && cachedMedia != "" {
-	// 	w.Header().Set("Content-Type", "application/json")
-	// 	w.Write([]byte(cachedMedia))
-	// 	return
-	// }
-
-	// Database query if not in cache
-	collection := client.Database("eventdb").Collection("media")
-	var media Media
-	err := collection.FindOne(context.TODO(), bson.M{"entityid": entityID, "entitytype": entityType, "id": mediaID}).Decode(&media)
+	media, err := loadMedia(r.Context(), entityType, entityID, mediaID)
 	if err != nil {
 		http.Error(w, "Media not found", http.StatusNotFound)
 		return
 	}
 
-	// Cache the result
-	// mediaJSON, _ := json.Marshal(media)
-	// RdxSet(cacheKey, string(mediaJSON)) // Assuming RdxSet is a function to cache data
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(media)
 }
@@ -160,73 +144,39 @@ func editMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	entityType := ps.ByName("entitytype")
 	entityID := ps.ByName("entityid")
 	mediaID := ps.ByName("id")
-	cacheKey := fmt.Sprintf("media:%s:%s", entityID, mediaID)
-	_ = r
-	// Check the cache first
-	cachedMedia, err := RdxGet(cacheKey) // Assuming RdxGet is a function to get cached data
-	if err == nil && cachedMedia != "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedMedia))
-		return
-	}
 
-	// Database query if not in cache
-	collection := client.Database("eventdb").Collection("media")
-	var media Media
-	err = collection.FindOne(context.TODO(), bson.M{"entityid": entityID, "entitytype": entityType, "id": mediaID}).Decode(&media)
+	media, err := loadMedia(r.Context(), entityType, entityID, mediaID)
 	if err != nil {
 		http.Error(w, "Media not found", http.StatusNotFound)
 		return
 	}
 
-	// Cache the result
-	mediaJSON, _ := json.Marshal(media)
-	RdxSet(cacheKey, string(mediaJSON)) // Assuming RdxSet is a function to cache data
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(media)
 }
 
+// loadMedia reads one media item through the cache
+func loadMedia(ctx context.Context, entityType, entityID, mediaID string) (Media, error) {
+	return cached(ctx, mediaCache, entityType+":"+entityID+":"+mediaID, func() (Media, error) {
+		var media Media
+		err := client.Database("eventdb").Collection("media").FindOne(context.TODO(), bson.M{"entityid": entityID, "entitytype": entityType, "id": mediaID}).Decode(&media)
+		return media, err
+	}, entityTag(entityType, entityID))
+}
+
 func getMedias(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	entityType := ps.ByName("entitytype")
 	entityID := ps.ByName("entityid")
-	cacheKey := fmt.Sprintf("medialist:%s", entityID)
-
-	// Check the cache first
-	cachedMedias, err := RdxGet(cacheKey)
-	if err == nil && cachedMedias != "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedMedias))
-		return
-	}
 
-	// Database query if not in cache
-	collection := client.Database("eventdb").Collection("media")
-	cursor, err := collection.Find(context.TODO(), bson.M{"entityid": entityID, "entitytype": entityType})
+	medias, err := cached(r.Context(), mediaListCache, entityType+":"+entityID, func() ([]Media, error) {
+		var medias []Media
+		err := findAll(client.Database("eventdb").Collection("media"), bson.M{"entityid": entityID, "entitytype": entityType}, &medias)
+		return medias, err
+	}, entityTag(entityType, entityID))
 	if err != nil {
 		http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var medias []Media
-	for cursor.Next(context.TODO()) {
-		var media Media
-		if err := cursor.Decode(&media); err != nil {
-			http.Error(w, "Failed to decode media", http.StatusInternalServerError)
-			return
-		}
-		medias = append(medias, media)
-	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
-
-	// Cache the result
-	mediasJSON, _ := json.Marshal(medias)
-	RdxSet(cacheKey, string(mediasJSON)) // Assuming RdxSet is a function to cache data
 
 	// Respond with media list
 	w.Header().Set("Content-Type", "application/json")
@@ -260,9 +210,7 @@ func deleteMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// 	return
 	// }
 
-	// Invalidate the cache
-	RdxDel(fmt.Sprintf("media:%s:%s", entityID, mediaID)) // Invalidate the media cache
-	RdxDel(fmt.Sprintf("medialist:%s", entityID))         // Invalidate the list cache
+	invalidate(r.Context(), entityTag(entityType, entityID))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -91,9 +91,31 @@ import (
 // 	json.NewEncoder(w).Encode(merch)
 // }
 
+// merchEntity is the event or place a merch route hangs off. Place merch is stored with the
+// place ID in eventid and entity_type "place"; event merch from before entity_type has none.
+func merchEntity(ps httprouter.Params) (entityType, entityID string) {
+	if placeID := ps.ByName("placeid"); placeID != "" {
+		return "place", placeID
+	}
+	return "event", ps.ByName("eventid")
+}
+
+func merchFilter(entityType, entityID string) bson.M {
+	if entityType == "place" {
+		return bson.M{"eventid": entityID, "entity_type": "place"}
+	}
+	return bson.M{"eventid": entityID, "entity_type": bson.M{"$ne": "place"}}
+}
+
+func merchItemFilter(entityType, entityID, merchID string) bson.M {
+	filter := merchFilter(entityType, entityID)
+	filter["merchid"] = merchID
+	return filter
+}
+
 // Function to handle the creation of merchandise
 func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
+	entityType, eventID := merchEntity(ps)
 	if eventID == "" {
 		http.Error(w, "Event ID is required", http.StatusBadRequest)
 		return
@@ -128,13 +150,14 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// Create a new Merch instance
 	merch := Merch{
-		EventID:   eventID,
-		Name:      name,
-		Price:     price,
-		Stock:     stock,
-		MerchID:   generateID(14), // Generate unique merchandise ID
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		EventID:    eventID,
+		EntityType: entityType,
+		Name:       name,
+		Price:      price,
+		Stock:      stock,
+		MerchID:    generateID(14), // Generate unique merchandise ID
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
 	}
 
 	// Handle banner file upload
@@ -185,6 +208,7 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		http.Error(w, "Failed to insert merchandise: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), entityTag(entityType, eventID))
 
 	// Respond with the created merchandise
 	w.Header().Set("Content-Type", "application/json")
@@ -197,31 +221,19 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 // Fetch a single merchandise item
 func getMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
+	entityType, eventID := merchEntity(ps)
 	merchID := ps.ByName("merchid")
-	cacheKey := fmt.Sprintf("merch:%s:%s", eventID, merchID)
-
-	// Check if the merch is cached
-	cachedMerch, err := RdxGet(cacheKey)
-	if err == nil && cachedMerch != "" {
-		// Return cached data
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedMerch))
-		return
-	}
 
-	collection := client.Database("eventdb").Collection("merch")
-	var merch Merch
-	err = collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}).Decode(&merch)
+	merch, err := cached(r.Context(), merchCache, entityType+":"+eventID+":"+merchID, func() (Merch, error) {
+		var merch Merch
+		err := client.Database("eventdb").Collection("merch").FindOne(context.TODO(), merchItemFilter(entityType, eventID, merchID)).Decode(&merch)
+		return merch, err
+	}, entityTag(entityType, eventID))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Merchandise not found: %v", err), http.StatusNotFound)
 		return
 	}
 
-	// Cache the result
-	merchJSON, _ := json.Marshal(merch)
-	RdxSet(cacheKey, string(merchJSON))
-
 	// Respond with merch data
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(merch)
@@ -229,50 +241,17 @@ func getMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 // Fetch a list of merchandise items
 func getMerchs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
-	cacheKey := fmt.Sprintf("merchlist:%s", eventID)
-
-	// Check if the merch list is cached
-	cachedMerchs, err := RdxGet(cacheKey)
-	if err == nil && cachedMerchs != "" {
-		// Return cached list
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedMerchs))
-		return
-	}
-
-	collection := client.Database("eventdb").Collection("merch")
-	var merchList []Merch
-	filter := bson.M{"eventid": eventID}
+	entityType, eventID := merchEntity(ps)
 
-	cursor, err := collection.Find(context.Background(), filter)
+	merchList, err := cached(r.Context(), merchListCache, entityType+":"+eventID, func() ([]Merch, error) {
+		merchList := []Merch{}
+		err := findAll(client.Database("eventdb").Collection("merch"), merchFilter(entityType, eventID), &merchList)
+		return merchList, err
+	}, entityTag(entityType, eventID))
 	if err != nil {
 		http.Error(w, "Failed to fetch merchandise", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	for cursor.Next(context.Background()) {
-		var merch Merch
-		if err := cursor.Decode(&merch); err != nil {
-			http.Error(w, "Failed to decode merchandise", http.StatusInternalServerError)
-			return
-		}
-		merchList = append(merchList, merch)
-	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
-
-	if len(merchList) == 0 {
-		merchList = []Merch{}
-	}
-
-	// Cache the list
-	merchListJSON, _ := json.Marshal(merchList)
-	RdxSet(cacheKey, string(merchListJSON))
 
 	// Respond with the list of merch
 	w.Header().Set("Content-Type", "application/json")
@@ -281,7 +260,7 @@ func getMerchs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 // Edit a merchandise item
 func editMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
+	entityType, eventID := merchEntity(ps)
 	merchID := ps.ByName("merchid")
 
 	// Parse the request body
@@ -313,7 +292,7 @@ func editMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	collection := client.Database("eventdb").Collection("merch")
 	updateResult, err := collection.UpdateOne(
 		context.TODO(),
-		bson.M{"eventid": eventID, "merchid": merchID},
+		merchItemFilter(entityType, eventID, merchID),
 		bson.M{"$set": updateFields},
 	)
 	if err != nil {
@@ -327,8 +306,7 @@ func editMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Invalidate the specific merch cache
-	RdxDel(fmt.Sprintf("merch:%s:%s", eventID, merchID))
+	invalidate(r.Context(), entityTag(entityType, eventID))
 
 	// Send response
 	// w.Header().Set("Content-Type", "application/json")
@@ -345,12 +323,12 @@ func editMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 // Delete a merchandise item
 func deleteMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
+	entityType, eventID := merchEntity(ps)
 	merchID := ps.ByName("merchid")
 
 	// Delete the merch from MongoDB
 	collection := client.Database("eventdb").Collection("merch")
-	deleteResult, err := collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID})
+	deleteResult, err := collection.DeleteOne(context.TODO(), merchItemFilter(entityType, eventID, merchID))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to delete merchandise: %v", err), http.StatusInternalServerError)
 		return
@@ -362,8 +340,7 @@ func deleteMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Invalidate the cache
-	RdxDel(fmt.Sprintf("merch:%s:%s", eventID, merchID))
+	invalidate(r.Context(), entityTag(entityType, eventID))
 
 	// // Send response
 	// w.WriteHeader(http.StatusOK)
@@ -377,7 +354,7 @@ func deleteMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 }
 
 func buyMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	eventID := ps.ByName("eventid")
+	entityType, eventID := merchEntity(ps)
 	merchID := ps.ByName("merchid")
 
 	// Parse the request body to extract quantity
@@ -393,7 +370,7 @@ func buyMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Find the merch in the database
 	collection := client.Database("eventdb").Collection("merch")
 	var merch Merch // Define the Merch struct based on your schema
-	err = collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}).Decode(&merch)
+	err = collection.FindOne(context.TODO(), merchItemFilter(entityType, eventID, merchID)).Decode(&merch)
 	if err != nil {
 		http.Error(w, "Merch not found or other error", http.StatusNotFound)
 		return
@@ -407,11 +384,15 @@ func buyMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	// Decrease the merch stock by the requested quantity
 	update := bson.M{"$inc": bson.M{"stock": -requestData.Quantity}}
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}, update)
+	_, err = collection.UpdateOne(context.TODO(), merchItemFilter(entityType, eventID, merchID), update)
 	if err != nil {
 		http.Error(w, "Failed to update merch stock", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), entityTag(entityType, eventID))
+
+	userID, _ := r.Context().Value(userIDKey).(string)
+	recordPurchase(userID, "merch", eventID, merchID, merch.Name, merch.Price, requestData.Quantity)
 
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	oidcStateTTL        = 10 * time.Minute
+	oidcJWKSMinInterval = time.Minute // don't refetch keys more often than this on unknown kids
+)
+
+// oidcProvider is an OpenID Connect issuer we accept logins from.
+// Endpoints come from the issuer's discovery document, fetched on first use.
+type oidcProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is what we remember between the redirect to the provider and the callback
+type oidcState struct {
+	Provider   string `json:"provider"`
+	Verifier   string `json:"verifier"`
+	Nonce      string `json:"nonce"`
+	LinkUserID string `json:"link_userid,omitempty"` // set when a signed in user is linking the provider
+}
+
+type oidcIDClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+var (
+	oidcProviders  = map[string]*oidcProvider{}
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// loadOIDCProviders reads OIDC_PROVIDERS (comma separated names) and for each name
+// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and optional _SCOPES.
+func loadOIDCProviders() error {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       os.Getenv(prefix + "SCOPES"),
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return fmt.Errorf("OIDC provider %s needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+		if p.Scopes == "" {
+			p.Scopes = "openid email profile"
+		}
+		oidcProviders[name] = p
+	}
+	return nil
+}
+
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := fetchJSON(p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("error fetching discovery document: %w", err)
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// keyFunc resolves ID token keys from the provider's JWKS, refetching once when a kid is unknown
+func (p *oidcProvider) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysFetched) > oidcJWKSMinInterval
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := fetchJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %s of OIDC provider %s: %v", jwk.Kid, p.Name, err)
+			continue
+		}
+		keys[jwk.Kid] = pub
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// publicKey turns a JWK into a key usable by the jwt package
+func (k JWK) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func fetchJSON(url string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+// takeOIDCState returns what oidcStart stored for the state, once. It lives in appCache,
+// so with CACHE_BACKEND=memory a login has to come back to the same instance.
+func takeOIDCState(state string) (oidcState, bool) {
+	var stored oidcState
+	if state == "" {
+		return stored, false
+	}
+	key := oidcStateKey(state)
+	data, ok, err := appCache.Get(context.TODO(), key)
+	if err != nil || !ok {
+		return stored, false
+	}
+	appCache.Del(context.TODO(), key)
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return stored, false
+	}
+	return stored, true
+}
+
+// oidcStart redirects the browser to the provider with a fresh state, nonce and PKCE challenge
+func oidcStart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	authURL, err := p.authorizationURL("")
+	if err != nil {
+		log.Printf("Error starting OIDC login with %s: %v", p.Name, err)
+		http.Error(w, "Failed to start login", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLink starts the same flow for a signed in user, whose account the identity is then linked to.
+// The URL is returned rather than redirected to, as the request carries the user's token.
+func oidcLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	authURL, err := p.authorizationURL(userID)
+	if err != nil {
+		log.Printf("Error starting OIDC link with %s: %v", p.Name, err)
+		http.Error(w, "Failed to start linking", http.StatusBadGateway)
+		return
+	}
+	sendJSONResponse(w, http.StatusOK, map[string]string{"url": authURL})
+}
+
+// authorizationURL stores a fresh state, nonce and PKCE verifier and returns where to send the browser
+func (p *oidcProvider) authorizationURL(linkUserID string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	state, err1 := generateSecureToken()
+	nonce, err2 := generateSecureToken()
+	verifier, err3 := generateSecureToken()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return "", err
+	}
+
+	stored, _ := json.Marshal(oidcState{Provider: p.Name, Verifier: verifier, Nonce: nonce, LinkUserID: linkUserID})
+	if err := appCache.Set(context.TODO(), oidcStateKey(state), stored, oidcStateTTL); err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", p.Scopes)
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	return d.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+// oidcCallback exchanges the code, validates the ID token and logs the matching user in
+func oidcCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, "Login was not completed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	state, ok := takeOIDCState(query.Get("state"))
+	if !ok || state.Provider != p.Name {
+		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	idToken, err := p.exchangeCode(query.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange with %s failed: %v", p.Name, err)
+		http.Error(w, "Failed to complete login", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := p.verifyIDToken(idToken, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token from %s rejected: %v", p.Name, err)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if state.LinkUserID != "" {
+		user, err = linkOIDCIdentity(state.LinkUserID, p.Name, claims)
+	} else {
+		user, err = findOrLinkOIDCUser(p.Name, claims)
+	}
+	if err == errOIDCEmailTaken || err == errOIDCIdentityTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error linking OIDC identity: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithLogin(w, r, user)
+}
+
+func (p *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	resp, err := oidcHTTPClient.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	return tokens.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(idToken, nonce string) (*oidcIDClaims, error) {
+	claims := &oidcIDClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, p.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, errors.New("azp does not match client id")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub")
+	}
+	return claims, nil
+}
+
+var (
+	errOIDCEmailTaken    = errors.New("an account with this email already exists, sign in with your password and link the provider from there")
+	errOIDCIdentityTaken = errors.New("this identity is already linked to another account")
+)
+
+// emailLinkAllowed reports whether an unlinked identity may be attached to the account that has
+// its email. Both sides must have verified the address, or whoever set it first could take over
+// the other's sign-ins.
+func emailLinkAllowed(user User, claims *oidcIDClaims) bool {
+	return claims.EmailVerified && user.IsVerified
+}
+
+// findOrLinkOIDCUser returns the user linked to the identity. An unlinked identity is attached
+// to the account with the same email when emailLinkAllowed, otherwise a new account is created.
+func findOrLinkOIDCUser(provider string, claims *oidcIDClaims) (User, error) {
+	identity := OIDCIdentity{Provider: provider, Subject: claims.Subject}
+
+	var user User
+	err := userCollection.FindOne(context.TODO(), bson.M{"oidc_identities": identity}).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	if claims.Email != "" {
+		err = userCollection.FindOne(context.TODO(), bson.M{"email": claims.Email}).Decode(&user)
+		if err == nil {
+			if !emailLinkAllowed(user, claims) {
+				return User{}, errOIDCEmailTaken
+			}
+			_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": user.UserID}, bson.M{
+				"$addToSet": bson.M{"oidc_identities": identity},
+			})
+			return user, err
+		} else if err != mongo.ErrNoDocuments {
+			return User{}, err
+		}
+	}
+
+	username, err := availableUsername(claims)
+	if err != nil {
+		return User{}, err
+	}
+	user = User{
+		UserID:         "u" + GenerateName(10),
+		Username:       username,
+		Email:          claims.Email,
+		Name:           claims.Name,
+		Role:           roleUser,
+		IsVerified:     claims.Email != "" && claims.EmailVerified,
+		CreatedAt:      time.Now(),
+		OIDCIdentities: []OIDCIdentity{identity},
+	}
+	_, err = userCollection.InsertOne(context.TODO(), user)
+	return user, err
+}
+
+// linkOIDCIdentity attaches the identity to a signed in user, who proved the account is theirs
+func linkOIDCIdentity(userID, provider string, claims *oidcIDClaims) (User, error) {
+	identity := OIDCIdentity{Provider: provider, Subject: claims.Subject}
+
+	var owner User
+	err := userCollection.FindOne(context.TODO(), bson.M{"oidc_identities": identity}).Decode(&owner)
+	if err == nil && owner.UserID != userID {
+		return User{}, errOIDCIdentityTaken
+	} else if err != nil && err != mongo.ErrNoDocuments {
+		return User{}, err
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		return User{}, err
+	}
+	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": userID}, bson.M{
+		"$addToSet": bson.M{"oidc_identities": identity},
+	})
+	return user, err
+}
+
+var usernameCleaner = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func availableUsername(claims *oidcIDClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = usernameCleaner.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		err := userCollection.FindOne(context.TODO(), bson.M{"username": candidate}).Err()
+		if err == mongo.ErrNoDocuments {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+		candidate = base + "_" + strings.ToLower(GenerateName(4))
+	}
+	return "", errors.New("could not find a free username")
+}
+
+// respondWithLogin finishes a login the same way the password flow does. When
+// OIDC_FRONTEND_REDIRECT is set the browser is sent back to the app with the result in the fragment.
+func respondWithLogin(w http.ResponseWriter, r *http.Request, user User) {
+	result := url.Values{}
+	if user.TOTPEnabled {
+		challenge, err := createLoginChallenge(user.UserID, user.Username)
+		if err != nil {
+			http.Error(w, "Failed to start two-factor login", http.StatusInternalServerError)
+			return
+		}
+		result.Set("twoFactorRequired", "true")
+		result.Set("challenge", challenge)
+	} else {
+		tokenString, refreshToken, err := issueTokens(user, r)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		result.Set("token", tokenString)
+		result.Set("refreshToken", refreshToken)
+		result.Set("userid", user.UserID)
+	}
+
+	if redirect := os.Getenv("OIDC_FRONTEND_REDIRECT"); redirect != "" {
+		http.Redirect(w, r, redirect+"#"+result.Encode(), http.StatusFound)
+		return
+	}
+
+	data := map[string]string{}
+	for k := range result {
+		data[k] = result.Get(k)
+	}
+	sendResponse(w, http.StatusOK, data, "Login successful", nil)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+
+	"naevis/tools/mockoidc/oidcmock"
+)
+
+// startMockOIDC serves a mock issuer and registers it as the "mock" provider. configure runs
+// before the issuer starts serving.
+func startMockOIDC(t *testing.T, configure func(*oidcmock.Issuer)) *oidcProvider {
+	t.Helper()
+	prevCache := appCache
+	appCache = newMemoryCache()
+
+	iss, err := oidcmock.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(iss.Handler())
+	iss.URL = "http://" + srv.Listener.Addr().String()
+	if configure != nil {
+		configure(iss)
+	}
+	srv.Start()
+
+	p := &oidcProvider{
+		Name:        "mock",
+		Issuer:      iss.URL,
+		ClientID:    "naevis",
+		RedirectURL: "http://api.test/api/auth/oidc/mock/callback",
+		Scopes:      "openid email profile",
+	}
+	oidcProviders[p.Name] = p
+	t.Cleanup(func() {
+		srv.Close()
+		delete(oidcProviders, p.Name)
+		appCache = prevCache
+	})
+	return p
+}
+
+// authorize runs oidcStart and follows the redirect through the mock, returning the
+// authorization request and the query the provider sends back to the callback
+func authorize(t *testing.T, p *oidcProvider) (request, callback url.Values) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	oidcStart(rec, httptest.NewRequest("GET", "/api/auth/oidc/mock/start", nil), httprouter.Params{{Key: "provider", Value: p.Name}})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start: got %d %s", rec.Code, rec.Body.String())
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %d %v", resp.StatusCode, err)
+	}
+	if back.Host != "api.test" {
+		t.Fatalf("redirected to %s, want the callback", back)
+	}
+	return authURL.Query(), back.Query()
+}
+
+func callback(p *oidcProvider, query url.Values) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/auth/oidc/mock/callback?"+query.Encode(), nil)
+	oidcCallback(rec, r, httprouter.Params{{Key: "provider", Value: p.Name}})
+	return rec
+}
+
+// tamperState rewrites what was stored for the state of an authorization in progress
+func tamperState(t *testing.T, stateParam string, change func(*oidcState)) {
+	t.Helper()
+	state, ok := takeOIDCState(stateParam)
+	if !ok {
+		t.Fatal("state was not stored")
+	}
+	change(&state)
+	data, _ := json.Marshal(state)
+	if err := appCache.Set(context.Background(), oidcStateKey(stateParam), data, oidcStateTTL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := startMockOIDC(t, nil)
+	request, back := authorize(t, p)
+
+	if request.Get("code_challenge_method") != "S256" || request.Get("nonce") == "" || request.Get("state") == "" {
+		t.Fatalf("authorization request is missing PKCE, nonce or state: %v", request)
+	}
+	if back.Get("state") != request.Get("state") {
+		t.Fatalf("state changed on the way back: %q != %q", back.Get("state"), request.Get("state"))
+	}
+
+	state, ok := takeOIDCState(back.Get("state"))
+	if !ok {
+		t.Fatal("state was not stored")
+	}
+	if _, again := takeOIDCState(back.Get("state")); again {
+		t.Fatal("state could be used twice")
+	}
+	sum := sha256.Sum256([]byte(state.Verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != request.Get("code_challenge") {
+		t.Fatal("code challenge doesn't match the stored verifier")
+	}
+	if state.Nonce != request.Get("nonce") || state.LinkUserID != "" {
+		t.Fatalf("unexpected stored state %+v", state)
+	}
+
+	idToken, err := p.exchangeCode(back.Get("code"), state.Verifier)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	claims, err := p.verifyIDToken(idToken, state.Nonce)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if claims.Subject != "mock-user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	if _, err := p.exchangeCode(back.Get("code"), state.Verifier); err == nil {
+		t.Fatal("code could be exchanged twice")
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*oidcmock.Issuer)
+		state     func(*oidcState)
+		query     func(url.Values)
+		want      int
+	}{
+		{name: "unknown state", query: func(q url.Values) { q.Set("state", "forged") }, want: http.StatusBadRequest},
+		{name: "state of another provider", state: func(s *oidcState) { s.Provider = "other" }, want: http.StatusBadRequest},
+		{name: "wrong PKCE verifier", state: func(s *oidcState) { s.Verifier = "not-the-verifier" }, want: http.StatusBadGateway},
+		{name: "missing code", query: func(q url.Values) { q.Del("code") }, want: http.StatusBadGateway},
+		{name: "nonce mismatch", state: func(s *oidcState) { s.Nonce = "another-nonce" }, want: http.StatusUnauthorized},
+		{name: "wrong audience", configure: func(i *oidcmock.Issuer) { i.Audience = "someone-else" }, want: http.StatusUnauthorized},
+		{name: "wrong issuer", configure: func(i *oidcmock.Issuer) { i.TokenIssuer = "http://evil.test" }, want: http.StatusUnauthorized},
+		{name: "provider error", query: func(q url.Values) { q.Set("error", "access_denied") }, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startMockOIDC(t, tt.configure)
+			_, back := authorize(t, p)
+			if tt.state != nil {
+				tamperState(t, back.Get("state"), tt.state)
+			}
+			if tt.query != nil {
+				tt.query(back)
+			}
+			if rec := callback(p, back); rec.Code != tt.want {
+				t.Fatalf("got %d %q, want %d", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailLinkAllowed(t *testing.T) {
+	tests := []struct {
+		name          string
+		localVerified bool
+		idpVerified   bool
+		want          bool
+	}{
+		{"both verified", true, true, true},
+		{"provider didn't verify", true, false, false},
+		{"local account didn't verify", false, true, false},
+		{"neither verified", false, false, false},
+	}
+	for _, tt := range tests {
+		user := User{Email: "alice@example.com", IsVerified: tt.localVerified}
+		claims := &oidcIDClaims{Email: "alice@example.com", EmailVerified: tt.idpVerified}
+		if got := emailLinkAllowed(user, claims); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const resetTokenTTL = time.Hour
+
+// forgotPassword mails a reset link if the email belongs to an account.
+// The response is the same either way so it can't be used to probe for accounts.
+func forgotPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	// Mailing happens in the background so the response time doesn't depend on whether the account exists
+	go func(email string) {
+		var user User
+		if err := userCollection.FindOne(context.TODO(), bson.M{"email": email}).Decode(&user); err != nil {
+			return
+		}
+		if err := sendResetEmail(user); err != nil {
+			log.Printf("Error sending password reset email to user %s: %v", user.UserID, err)
+		}
+	}(body.Email)
+
+	sendResponse(w, http.StatusOK, nil, "If that email is registered, a reset link is on its way", nil)
+}
+
+func sendResetEmail(user User) error {
+	token, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = userCollection.UpdateOne(
+		context.TODO(),
+		bson.M{"userid": user.UserID},
+		bson.M{"$set": bson.M{"reset_token": hashToken(token), "reset_expiry": time.Now().Add(resetTokenTTL)}},
+	)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("APP_BASE_URL") + "/reset-password?token=" + token
+	body := fmt.Sprintf("Hi %s,\r\n\r\nSomeone asked to reset the password of your account. If it was you, open the link below:\r\n\r\n%s\r\n\r\nThe link expires in 1 hour. If you didn't ask for this you can ignore this email.\r\n", user.Username, link)
+	return mailer.Send(user.Email, "Reset your password", body)
+}
+
+// resetPassword sets a new password using a reset token and logs out every session
+func resetPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" || body.Password == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// Matching and clearing the token in one update keeps it single-use
+	var user User
+	err = userCollection.FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"reset_token": hashToken(body.Token), "reset_expiry": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$set":   bson.M{"password": string(hashedPassword), "updated_at": time.Now()},
+			"$unset": bson.M{"reset_token": "", "reset_expiry": ""},
+		},
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(user.UserID); err != nil {
+		log.Printf("Error revoking sessions for user %s: %v", user.UserID, err)
+	}
+	if err := revokeUserPATs(user.UserID); err != nil {
+		log.Printf("Error revoking access tokens for user %s: %v", user.UserID, err)
+	}
+	clearLoginFailures(user.Username, user.Email)
+
+	sendResponse(w, http.StatusOK, nil, "Password has been reset", nil)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Personal access tokens let scripts use the API without going through login.
+// They only work on routes wrapped in requireScope, and only with a matching scope.
+
+const (
+	patPrefix = "nvs_pat_"
+
+	defaultPATLifetime = 30 * 24 * time.Hour
+	maxPATLifetime     = 365 * 24 * time.Hour
+	maxPATsPerUser     = 50
+	patLastUsedEvery   = time.Minute // last_used is only written this often
+)
+
+// patScopes lists every scope a token can be given. A write scope includes the matching read scope.
+var patScopes = map[string]string{
+	"events:write":  "Create, edit and delete your events",
+	"tickets:read":  "Read ticket inventory of events",
+	"tickets:write": "Create, edit and delete tickets of your events",
+	"merch:write":   "Create, edit and delete merchandise of your events and places",
+	"media:write":   "Upload, edit and delete your media",
+	"places:write":  "Create, edit and delete your places",
+	"posts:read":    "Read your feed",
+	"posts:write":   "Create, edit and delete your posts",
+	"profile:read":  "Read your profile",
+}
+
+const requiredScopeKey contextKey = "requiredScope"
+
+func patCollection() *mongo.Collection {
+	return client.Database("eventdb").Collection("access_tokens")
+}
+
+// hasScope reports whether the granted scopes cover required
+func hasScope(granted []string, required string) bool {
+	for _, scope := range granted {
+		if scope == required {
+			return true
+		}
+		if resource, action, ok := strings.Cut(required, ":"); ok && action == "read" && scope == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+// requireScope names the scope a personal access token needs for the route. It wraps authenticate.
+// Session tokens are not limited by scopes.
+func requireScope(scope string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := context.WithValue(r.Context(), requiredScopeKey, scope)
+		next(w, r.WithContext(ctx), ps)
+	}
+}
+
+// authenticatePAT is the part of authenticate handling personal access tokens
+func authenticatePAT(w http.ResponseWriter, r *http.Request, ps httprouter.Params, token string, next httprouter.Handle) {
+	var pat AccessToken
+	err := patCollection().FindOne(context.TODO(), bson.M{"token_hash": hashToken(token)}).Decode(&pat)
+	if err != nil || time.Now().After(pat.ExpiresAt) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	// Tokens created before the user's sessions were revoked (password change or reset) go with them
+	if isTokenRevoked(&Claims{UserID: pat.UserID, RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(pat.CreatedAt)}}) {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	required, _ := r.Context().Value(requiredScopeKey).(string)
+	if required == "" {
+		http.Error(w, "Personal access tokens can't be used on this route", http.StatusForbidden)
+		return
+	}
+	if !hasScope(pat.Scopes, required) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+required+`"`)
+		http.Error(w, "Token is missing the "+required+" scope", http.StatusForbidden)
+		return
+	}
+
+	if time.Since(pat.LastUsed) > patLastUsedEvery {
+		_, err := patCollection().UpdateOne(context.TODO(), bson.M{"tokenid": pat.TokenID}, bson.M{"$set": bson.M{"last_used": time.Now()}})
+		if err != nil {
+			log.Printf("Error updating last use of token %s: %v", pat.TokenID, err)
+		}
+	}
+
+	var user struct {
+		Username string `bson:"username"`
+	}
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": pat.UserID}).Decode(&user); err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	next(w, r.WithContext(withClaims(r.Context(), &Claims{UserID: pat.UserID, Username: user.Username})), ps)
+}
+
+// revokeUserPATs deletes every personal access token of the user
+func revokeUserPATs(userID string) error {
+	_, err := patCollection().DeleteMany(context.TODO(), bson.M{"userid": userID})
+	return err
+}
+
+// getAccessTokens lists the user's tokens without their secrets
+func getAccessTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cursor, err := patCollection().Find(context.TODO(), bson.M{"userid": userID})
+	if err != nil {
+		http.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+	tokens := []AccessToken{}
+	if err := cursor.All(context.TODO(), &tokens); err != nil {
+		http.Error(w, "Failed to fetch tokens", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, tokens)
+}
+
+// createAccessToken issues a token. The plain token is only ever shown in this response.
+func createAccessToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len(body.Name) > 100 {
+		http.Error(w, "Name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(body.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if _, ok := patScopes[scope]; !ok {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	lifetime := defaultPATLifetime
+	if body.ExpiresInDays > 0 {
+		lifetime = time.Duration(body.ExpiresInDays) * 24 * time.Hour
+	}
+	if lifetime > maxPATLifetime {
+		http.Error(w, "Tokens can't live longer than 365 days", http.StatusBadRequest)
+		return
+	}
+
+	count, err := patCollection().CountDocuments(context.TODO(), bson.M{"userid": userID})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxPATsPerUser {
+		http.Error(w, "Too many tokens, revoke some first", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateSecureToken()
+	tokenID, err2 := generateTokenID()
+	if err != nil || err2 != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	token := patPrefix + secret
+
+	pat := AccessToken{
+		TokenID:   tokenID,
+		UserID:    userID,
+		Name:      body.Name,
+		Scopes:    body.Scopes,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if _, err := patCollection().InsertOne(context.TODO(), pat); err != nil {
+		http.Error(w, "Failed to save token", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusCreated, map[string]interface{}{"token": token, "details": pat}, "Token created, copy it now as it won't be shown again", nil)
+}
+
+// deleteAccessToken revokes one of the user's tokens
+func deleteAccessToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := patCollection().DeleteOne(context.TODO(), bson.M{"tokenid": ps.ByName("id"), "userid": userID})
+	if err != nil {
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, nil, "Token revoked", nil)
+}
+
+// getAccessTokenScopes lists the scopes tokens can be given
+func getAccessTokenScopes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sendJSONResponse(w, http.StatusOK, patScopes)
+}
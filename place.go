@@ -111,6 +111,8 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		http.Error(w, "Error creating place", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), placesTag)
+	reindexPlace(r.Context(), place)
 
 	// Respond with the created place
 	w.WriteHeader(http.StatusCreated)
@@ -133,35 +135,15 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 func getPlaces(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// // Check if places are cached
-	// cachedPlaces, err := RdxGet("places")
-	// if err == nil && cachedPlaces != "" {
-	// 	// Return cached places if available
-	// 	w.Write([]byte(cachedPlaces))
-	// 	return
-	// }
-
-	collection := client.Database("eventdb").Collection("places")
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	places, err := cached(r.Context(), placesCache, "all", func() ([]Place, error) {
+		places := []Place{}
+		err := findAll(client.Database("eventdb").Collection("places"), bson.M{}, &places)
+		return places, err
+	}, placesTag)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var places []Place
-	if err = cursor.All(context.TODO(), &places); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Cache the result
-	placesJSON, _ := json.Marshal(places)
-	RdxSet("places", string(placesJSON))
-
-	if places == nil {
-		places = []Place{}
-	}
 
 	// Encode and return places data
 	json.NewEncoder(w).Encode(places)
@@ -281,14 +263,7 @@ func getPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	placeID := ps.ByName("placeid")
 
-	// Retrieve the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusUnauthorized)
-		return
-	}
-	log.Println("Requesting User ID:", requestingUserID)
-
+	// Ownership is checked by requireOwner
 	// Get the existing place from the database
 	var place Place
 	collection := client.Database("eventdb").Collection("places")
@@ -302,12 +277,6 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Ensure the requesting user is the creator of the place
-	if place.CreatedBy != requestingUserID {
-		http.Error(w, "You are not authorized to edit this place", http.StatusForbidden)
-		return
-	}
-
 	// Parse the multipart form
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		http.Error(w, "Unable to parse form", http.StatusBadRequest)
@@ -384,12 +353,15 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Invalidate cache (log success or failure)
-	if _, err := RdxDel("place:" + placeID); err != nil {
-		log.Printf("Cache deletion failed for place ID: %s. Error: %v", placeID, err)
-	} else {
-		log.Printf("Cache successfully invalidated for place ID: %s", placeID)
+	invalidate(r.Context(), placeTag(placeID), placesTag)
+	indexed := place
+	if name, ok := updateFields["name"].(string); ok {
+		indexed.Name = name
+	}
+	if description, ok := updateFields["description"].(string); ok {
+		indexed.Description = description
 	}
+	reindexPlace(r.Context(), indexed)
 
 	// // Respond with updated fields
 	// w.Header().Set("Content-Type", "application/json")
@@ -418,14 +390,7 @@ func deletePlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	placeID := ps.ByName("placeid")
 	var place Place
 
-	// Get the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusBadRequest)
-		return
-	}
-	// log.Println("Requesting User ID:", requestingUserID)
-
+	// Ownership is checked by requireOwner
 	// Get the place from the database using placeID
 	collection := client.Database("eventdb").Collection("places")
 	err := collection.FindOne(context.TODO(), bson.M{"placeid": placeID}).Decode(&place)
@@ -438,19 +403,14 @@ func deletePlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Check if the place was created by the requesting user
-	if place.CreatedBy != requestingUserID {
-		http.Error(w, "You are not authorized to delete this place", http.StatusForbidden)
-		return
-	}
-
 	// Delete the place from MongoDB
 	_, err = collection.DeleteOne(context.TODO(), bson.M{"placeid": placeID})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	RdxDel("place:" + placeID) // Invalidate the cache for the deleted place
+	invalidate(r.Context(), placeTag(placeID), placesTag)
+	dropPlaceIndex(r.Context(), placeID)
 
 	// Respond with success
 	w.WriteHeader(http.StatusOK)
@@ -462,26 +422,13 @@ func deletePlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 }
 
 /***************************************************/
+// getPlaceSuggestions looks the query up in the autocomplete index, see placeindex.go
 func getPlaceSuggestions(ctx context.Context, query string) ([]Suggestion, error) {
-	var suggestions []Suggestion
-
-	// Use Redis KEYS command to find matching place suggestions by name
-	// (this is a simple approach, you may want a more efficient search strategy)
-	keys, err := conn.Keys(ctx, fmt.Sprintf("suggestions:place:%s*", query)).Result()
+	suggestions, err := searchPlaceIndex(ctx, query, placeSuggestLimit)
 	if err != nil {
-		return nil, err
+		log.Printf("Place index unavailable, searching Mongo: %v", err)
+		return searchPlacesMongo(ctx, query, placeSuggestLimit)
 	}
-
-	// Retrieve the corresponding place data
-	for _, key := range keys {
-		var suggestion Suggestion
-		err := conn.Get(ctx, key).Scan(&suggestion)
-		if err != nil {
-			return nil, err
-		}
-		suggestions = append(suggestions, suggestion)
-	}
-
 	return suggestions, nil
 }
 
@@ -492,13 +439,11 @@ func suggestionsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 		return
 	}
 
-	ctx := context.Background()
-	suggestions, err := getPlaceSuggestions(ctx, query)
+	suggestions, err := getPlaceSuggestions(r.Context(), query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error fetching suggestions: %v", err), http.StatusInternalServerError)
 		return
 	}
-	log.Println("handler sugg : ", suggestions)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Place autocomplete is a set of Redis sorted sets, one per prefix:
+//   autocomplete:place:p:<prefix>  - place ids scored by Place.Views
+//   autocomplete:place:entries     - hash of place id to what a suggestion shows
+// Names are folded (lowercase, accents dropped) before indexing, and every word of a name starts
+// prefixes, so "cafe" and "Ca" both find "Le Café Noir". createPlace, editPlace and deletePlace
+// keep it current; `naevis reindex-places` rebuilds it from Mongo, which also refreshes the scores.
+
+const (
+	placePrefixKey    = "autocomplete:place:p:"
+	placeEntriesKey   = "autocomplete:place:entries"
+	maxPrefixLen      = 20 // runes, longer queries are filtered after the lookup
+	placeSuggestLimit = 10
+)
+
+type placeEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+var nonWord = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// foldName lowercases s, strips accents and collapses everything else to single spaces
+func foldName(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return strings.TrimSpace(nonWord.ReplaceAllString(b.String(), " "))
+}
+
+// nameSuffixes are the folded name starting at each of its words
+func nameSuffixes(name string) []string {
+	words := strings.Fields(foldName(name))
+	suffixes := make([]string, len(words))
+	for i := range words {
+		suffixes[i] = strings.Join(words[i:], " ")
+	}
+	return suffixes
+}
+
+func placePrefixes(name string) []string {
+	seen := map[string]bool{}
+	var prefixes []string
+	for _, suffix := range nameSuffixes(name) {
+		runes := []rune(suffix)
+		for n := 1; n <= len(runes) && n <= maxPrefixLen; n++ {
+			prefix := string(runes[:n])
+			if runes[n-1] != ' ' && !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// indexPlace adds the place, or moves it if its name changed since it was last indexed
+func indexPlace(ctx context.Context, place Place) error {
+	entry, err := json.Marshal(placeEntry{Name: place.Name, Description: place.Description})
+	if err != nil {
+		return err
+	}
+	old, err := conn.HGet(ctx, placeEntriesKey, place.PlaceID).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("error while doing HGET command in redis : %w", err)
+	}
+
+	_, err = conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		var previous placeEntry
+		if old != "" && json.Unmarshal([]byte(old), &previous) == nil {
+			for _, prefix := range placePrefixes(previous.Name) {
+				pipe.ZRem(ctx, placePrefixKey+prefix, place.PlaceID)
+			}
+		}
+		for _, prefix := range placePrefixes(place.Name) {
+			pipe.ZAdd(ctx, placePrefixKey+prefix, redis.Z{Score: float64(place.Views), Member: place.PlaceID})
+		}
+		pipe.HSet(ctx, placeEntriesKey, place.PlaceID, entry)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while indexing place %s : %w", place.PlaceID, err)
+	}
+	return nil
+}
+
+func unindexPlace(ctx context.Context, placeID string) error {
+	old, err := conn.HGet(ctx, placeEntriesKey, placeID).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error while doing HGET command in redis : %w", err)
+	}
+
+	var previous placeEntry
+	json.Unmarshal([]byte(old), &previous)
+	_, err = conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, prefix := range placePrefixes(previous.Name) {
+			pipe.ZRem(ctx, placePrefixKey+prefix, placeID)
+		}
+		pipe.HDel(ctx, placeEntriesKey, placeID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error while unindexing place %s : %w", placeID, err)
+	}
+	return nil
+}
+
+// reindexPlace and dropPlaceIndex are for handlers, a stale index isn't worth failing a write over
+func reindexPlace(ctx context.Context, place Place) {
+	if err := indexPlace(ctx, place); err != nil {
+		log.Printf("Error updating place index: %v", err)
+	}
+}
+
+func dropPlaceIndex(ctx context.Context, placeID string) {
+	if err := unindexPlace(ctx, placeID); err != nil {
+		log.Printf("Error updating place index: %v", err)
+	}
+}
+
+// searchPlaceIndex returns the most viewed places with a word starting with query
+func searchPlaceIndex(ctx context.Context, query string, limit int) ([]Suggestion, error) {
+	folded := foldName(query)
+	if folded == "" {
+		return []Suggestion{}, nil
+	}
+	runes := []rune(folded)
+	long := len(runes) > maxPrefixLen
+	fetch := limit
+	if long {
+		runes = runes[:maxPrefixLen]
+		fetch = limit * 5
+	}
+
+	ids, err := conn.ZRevRange(ctx, placePrefixKey+string(runes), 0, int64(fetch-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error while doing ZREVRANGE command in redis : %w", err)
+	}
+	if len(ids) == 0 {
+		return []Suggestion{}, nil
+	}
+	entries, err := conn.HMGet(ctx, placeEntriesKey, ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error while doing HMGET command in redis : %w", err)
+	}
+
+	suggestions := []Suggestion{}
+	for i, raw := range entries {
+		data, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var entry placeEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		if long && !hasWordPrefix(entry.Name, folded) {
+			continue
+		}
+		suggestions = append(suggestions, placeSuggestion(ids[i], entry.Name, entry.Description))
+		if len(suggestions) == limit {
+			break
+		}
+	}
+	return suggestions, nil
+}
+
+func hasWordPrefix(name, folded string) bool {
+	for _, suffix := range nameSuffixes(name) {
+		if strings.HasPrefix(suffix, folded) {
+			return true
+		}
+	}
+	return false
+}
+
+func placeSuggestion(placeID, name, description string) Suggestion {
+	return Suggestion{PlaceID: placeID, Type: "place", Title: name, Name: name, Description: description}
+}
+
+// searchPlacesMongo serves suggestions while Redis is down. It only matches the start of the
+// name, and only ignores case.
+func searchPlacesMongo(ctx context.Context, query string, limit int) ([]Suggestion, error) {
+	filter := bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(query), "$options": "i"}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "views", Value: -1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"placeid": 1, "name": 1, "description": 1})
+	cursor, err := client.Database("eventdb").Collection("places").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	suggestions := []Suggestion{}
+	for cursor.Next(ctx) {
+		var place Place
+		if err := cursor.Decode(&place); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, placeSuggestion(place.PlaceID, place.Name, place.Description))
+	}
+	return suggestions, cursor.Err()
+}
+
+// rebuildPlaceIndex drops the index and indexes every place in Mongo again
+func rebuildPlaceIndex(ctx context.Context) (int, error) {
+	var cursor uint64
+	for {
+		keys, next, err := conn.Scan(ctx, cursor, placePrefixKey+"*", 1000).Result()
+		if err != nil {
+			return 0, fmt.Errorf("error while doing SCAN command in redis : %w", err)
+		}
+		if len(keys) > 0 {
+			if err := conn.Unlink(ctx, keys...).Err(); err != nil {
+				return 0, fmt.Errorf("error while doing UNLINK command in redis : %w", err)
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if err := conn.Del(ctx, placeEntriesKey).Err(); err != nil {
+		return 0, fmt.Errorf("error while doing DEL command in redis : %w", err)
+	}
+
+	opts := options.Find().SetProjection(bson.M{"placeid": 1, "name": 1, "description": 1, "views": 1})
+	places, err := client.Database("eventdb").Collection("places").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer places.Close(ctx)
+
+	count := 0
+	for places.Next(ctx) {
+		var place Place
+		if err := places.Decode(&place); err != nil {
+			return count, err
+		}
+		if err := indexPlace(ctx, place); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, places.Err()
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -61,6 +61,8 @@ func getUserProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	json.NewEncoder(w).Encode(userProfile)
 }
 
+var errEmailTaken = errors.New("email already registered")
+
 func updateProfileFields(w http.ResponseWriter, r *http.Request, claims *Claims) (bson.M, error) {
 	update := bson.M{}
 
@@ -70,7 +72,22 @@ func updateProfileFields(w http.ResponseWriter, r *http.Request, claims *Claims)
 		_ = RdxHset("users", claims.UserID, username)
 	}
 	if email := r.FormValue("email"); email != "" {
-		update["email"] = email
+		var current User
+		if err := userCollection.FindOne(context.TODO(), bson.M{"userid": claims.UserID}).Decode(&current); err != nil {
+			return nil, err
+		}
+		if email != current.Email {
+			err := userCollection.FindOne(context.TODO(), bson.M{"email": email}).Err()
+			if err == nil {
+				return nil, errEmailTaken
+			} else if err != mongo.ErrNoDocuments {
+				return nil, err
+			}
+			// A new address has to be verified again; the zero expiry voids links sent to the old one
+			update["email"] = email
+			update["is_verified"] = false
+			update["verify_expiry"] = time.Time{}
+		}
 	}
 	if bio := r.FormValue("bio"); bio != "" {
 		update["bio"] = bio
@@ -92,21 +109,6 @@ func updateProfileFields(w http.ResponseWriter, r *http.Request, claims *Claims)
 	return update, nil
 }
 
-func validateJWT(tokenString string) (*Claims, error) {
-	if tokenString == "" || len(tokenString) < 8 {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unauthorized: %w", err)
-	}
-	return claims, nil
-}
-
 func applyProfileUpdates(username string, updates ...bson.M) error {
 	finalUpdate := bson.M{}
 	for _, update := range updates {
@@ -140,8 +142,7 @@ func respondWithUserProfile(w http.ResponseWriter, username string) error {
 
 // Update general profile information
 func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Validate JWT token
-	claims, err := validateJWT(r.Header.Get("Authorization"))
+	claims, err := requestClaims(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -153,12 +154,12 @@ func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	// Delete cached profile
-	RdxDel("profile:" + claims.Username)
-
 	// Update profile fields
 	fieldUpdates, err := updateProfileFields(w, r, claims)
-	if err != nil {
+	if err == errEmailTaken {
+		http.Error(w, "Email already registered", http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, "Failed to update profile fields", http.StatusInternalServerError)
 		return
 	}
@@ -168,6 +169,23 @@ func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), userTag(claims.UserID))
+
+	if email, ok := fieldUpdates["email"].(string); ok {
+		if err := sendVerificationEmail(User{UserID: claims.UserID, Username: claims.Username, Email: email}); err != nil {
+			log.Printf("Error sending verification email to user %s: %v", claims.UserID, err)
+		}
+	}
+
+	// A new password logs out every existing session and kills every access token
+	if _, ok := fieldUpdates["password"]; ok {
+		if err := revokeUserSessions(claims.UserID); err != nil {
+			log.Printf("Error revoking sessions for user %s: %v", claims.UserID, err)
+		}
+		if err := revokeUserPATs(claims.UserID); err != nil {
+			log.Printf("Error revoking access tokens for user %s: %v", claims.UserID, err)
+		}
+	}
 
 	// Respond with the updated profile
 	if err := respondWithUserProfile(w, claims.Username); err != nil {
@@ -177,8 +195,7 @@ func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 // Update profile picture
 func editProfilePic(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Validate JWT token
-	claims, err := validateJWT(r.Header.Get("Authorization"))
+	claims, err := requestClaims(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -202,6 +219,7 @@ func editProfilePic(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		http.Error(w, "Failed to update profile picture", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), userTag(claims.UserID))
 
 	// Respond with the updated profile
 	if err := respondWithUserProfile(w, claims.Username); err != nil {
@@ -211,8 +229,7 @@ func editProfilePic(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 
 // Update banner picture
 func editProfileBanner(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Validate JWT token
-	claims, err := validateJWT(r.Header.Get("Authorization"))
+	claims, err := requestClaims(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
@@ -236,6 +253,7 @@ func editProfileBanner(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		http.Error(w, "Failed to update banner picture", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), userTag(claims.UserID))
 
 	// Respond with the updated profile
 	if err := respondWithUserProfile(w, claims.Username); err != nil {
@@ -244,53 +262,24 @@ func editProfileBanner(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 }
 
 func getProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	claims := &Claims{}
-	jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	// Check Redis cache for profile
-	cachedProfile, err := RdxGet("profile:" + claims.Username)
-	if err == nil && cachedProfile != "" {
-		// If cached, return it
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedProfile))
+	claims, err := requestClaims(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var user User
-	err = userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	user, err := cached(r.Context(), profileCache, claims.Username, func() (User, error) {
+		var user User
+		err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+		user.Password, user.PasswordHash = "", "" // Do not return the password
+		return user, err
+	}, userTag(claims.UserID))
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		log.Printf("User not found: %s", claims.Username)
 		return
 	}
 
-	user.Password = "" // Do not return the password
-	userJSON, _ := json.Marshal(user)
-
-	// Cache the profile in Redis
-	RdxSet("profile:"+claims.Username, string(userJSON))
-
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
-
-func deleteProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	userID := r.Context().Value(userIDKey).(string) // Get the user ID from context
-	log.Println("beep: ", userID)
-
-	// Invalidate the cached profile in Redis
-	RdxDel("profile:" + userID)
-
-	_, err := userCollection.DeleteOne(context.TODO(), bson.M{"userid": userID})
-	if err != nil {
-		http.Error(w, "Error deleting profile", http.StatusInternalServerError)
-		log.Printf("Error deleting user profile: %v", err)
-		return
-	}
-
-	log.Printf("User profile deleted: %s", userID)
-
-	sendResponse(w, http.StatusOK, map[string]string{"": ""}, "Deletion successful", nil)
-}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func purchaseCollection() *mongo.Collection {
+	return client.Database("eventdb").Collection("purchases")
+}
+
+// recordPurchase keeps the buyer's side of a sale, the stock has already been taken.
+// A failure here is only logged so the buyer isn't told a completed purchase failed.
+func recordPurchase(userID, kind, eventID, itemID, name string, price float64, quantity int) {
+	purchase := Purchase{
+		UserID:      userID,
+		Kind:        kind,
+		EventID:     eventID,
+		ItemID:      itemID,
+		Name:        name,
+		Quantity:    quantity,
+		Price:       price,
+		PurchasedAt: time.Now(),
+	}
+	if _, err := purchaseCollection().InsertOne(context.TODO(), purchase); err != nil {
+		log.Printf("Error recording %s purchase of %s by %s: %v", kind, itemID, userID, err)
+	}
+}
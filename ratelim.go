@@ -1,40 +1,121 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
-	"sync"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/time/rate"
+	"github.com/redis/go-redis/v9"
 )
 
+// Rate limits live in Redis so every API instance behind the gateway shares them.
+// Each policy is a GCRA: requests are spaced Period/Limit apart, with up to Limit of them at once.
+
+type ratePolicy struct {
+	Name   string
+	Limit  int           // requests allowed in a burst
+	Period time.Duration // time to earn back the full burst
+}
+
 var (
-	//limiter    = rate.NewLimiter(1, 3) // 1 request per second with a burst of 3
-	limiters   = make(map[string]*rate.Limiter)
-	limitersMu sync.Mutex
+	authLimit   = ratePolicy{Name: "auth", Limit: 10, Period: time.Minute}
+	writeLimit  = ratePolicy{Name: "writes", Limit: 60, Period: time.Minute}
+	searchLimit = ratePolicy{Name: "search", Limit: 30, Period: time.Minute}
+	uploadLimit = ratePolicy{Name: "uploads", Limit: 20, Period: time.Hour}
 )
 
-func getLimiter(ip string) *rate.Limiter {
-	limitersMu.Lock()
-	defer limitersMu.Unlock()
+// gcraScript takes the key, the spacing between requests and the burst, both in milliseconds
+// and requests. It uses the Redis clock so instances with drifting clocks agree.
+// Returns allowed (0/1), remaining, retry after (ms) and reset (ms).
+var gcraScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local newTat = tat + interval
+local allowAt = newTat - burst * interval
+
+if now < allowAt then
+	return {0, 0, allowAt - now, tat - now}
+end
+
+redis.call('SET', KEYS[1], newTat, 'PX', newTat - now)
+return {1, math.floor((now - allowAt) / interval), 0, newTat - now}
+`)
+
+type rateResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+func (p ratePolicy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
 
-	// Check if a limiter already exists for this IP
-	if limiter, exists := limiters[ip]; exists {
-		return limiter
+// take spends one request of the policy for key
+func (p ratePolicy) take(ctx context.Context, key string) (rateResult, error) {
+	values, err := gcraScript.Run(ctx, conn, []string{"ratelimit:" + p.Name + ":" + key},
+		p.interval().Milliseconds(), p.Limit).Int64Slice()
+	if err != nil {
+		return rateResult{}, err
+	}
+	if len(values) != 4 {
+		return rateResult{}, fmt.Errorf("unexpected rate limit reply %v", values)
 	}
+	return rateResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		Reset:      time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
 
-	// Create a new limiter for this IP
-	limiter := rate.NewLimiter(1, 3)
-	limiters[ip] = limiter
-	return limiter
+// rateKey counts authenticated requests per user, so users behind one address don't share a limit
+func rateKey(r *http.Request) string {
+	if userID, ok := r.Context().Value(userIDKey).(string); ok && userID != "" {
+		return "user:" + userID
+	}
+	return "ip:" + clientIP(r)
 }
 
-func rateLimit(next httprouter.Handle) httprouter.Handle {
+// ceilSeconds rounds up so clients never retry a moment too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// rateLimit applies the policy to the route. Place it inside authenticate to limit per user.
+func rateLimit(policy ratePolicy, next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		ip := r.RemoteAddr // Get the user's IP address
-		limiter := getLimiter(ip)
+		result, err := policy.take(r.Context(), rateKey(r))
+		if err != nil {
+			// Redis being down shouldn't take the API with it, unless we've been told to refuse
+			log.Printf("Error checking %s rate limit: %v", policy.Name, err)
+			if rateLimitFailPolicy == failClosed {
+				w.Header().Set("Retry-After", redisRetryAfter())
+				http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next(w, r, ps)
+			return
+		}
+
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int64(policy.Period/time.Second)))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(result.Reset))
 
-		if !limiter.Allow() {
+		if !result.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
 			http.Error(w, "Too many requests", http.StatusTooManyRequests)
 			return
 		}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/redis/go-redis/v9"
     "github.com/joho/godotenv"
@@ -19,26 +21,47 @@ import (
         //~ DB:       0,  // use default DB
     //~ })
 	
-    var rxdurl string = os.Getenv("REDIS_URL")
-    var rxdopts, _ = redis.ParseURL(rxdurl)
-    var conn = redis.NewClient(rxdopts)
-
+var conn *redis.Client
 
+// init runs before main, so it loads .env itself to see REDIS_URL. The file is optional,
+// tests and containers pass the environment directly.
 func init() {
-  err := godotenv.Load()
-  if err != nil {
-    log.Fatal("Error loading .env file")
-  }
-RdxPing()
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file loaded, using the environment: %v", err)
+	}
+	opts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Printf("Invalid REDIS_URL, using localhost:6379: %v", err)
+		opts = &redis.Options{Addr: "localhost:6379"}
+	}
+	// Fail fast rather than hold requests up, see rdxhealth.go
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 2 * time.Second
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 500 * time.Millisecond
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 500 * time.Millisecond
+	}
+	if opts.PoolTimeout == 0 {
+		opts.PoolTimeout = time.Second
+	}
+	conn = redis.NewClient(opts)
+	conn.AddHook(healthHook{})
+	appCache = newCacheFromEnv()
+	if err := RdxPing(); err != nil {
+		rdxHealth.degrade(err)
+	}
 }
 
-func RdxPing() {
-ctx := context.Background()
-	k, err := conn.Ping(ctx).Result()
-	if err != nil {
-		fmt.Println("error while doing PING command in redis : %v", err)
+func RdxPing() error {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), redisProbeKey{}, true), redisProbeTimeout)
+	defer cancel()
+	if err := conn.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("error while doing PING command in redis : %w", err)
 	}
-	fmt.Println(k)
+	return nil
 }
 
 
@@ -48,11 +71,72 @@ func RdxSet(key, value string) error {
 
 	_, err := conn.Set(ctx, key, value, 0).Result()
 	if err != nil {
-		return fmt.Errorf("error while doing SET command in redis : %v", err)
+		return fmt.Errorf("error while doing SET command in redis : %w", err)
+	}
+
+	return err
+
+}
+
+// RdxSetEx sets a key that expires after ttl
+func RdxSetEx(key, value string, ttl time.Duration) error {
+
+	ctx := context.Background()
+
+	_, err := conn.Set(ctx, key, value, ttl).Result()
+	if err != nil {
+		return fmt.Errorf("error while doing SET command in redis : %w", err)
 	}
 
 	return err
+}
+
+func RdxExists(key string) (bool, error) {
+
+	ctx := context.Background()
+
+	n, err := conn.Exists(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("error while doing EXISTS command in redis : %w", err)
+	}
+
+	return n > 0, err
+}
+
+// incrScript increments and, in the same step, gives the counter a ttl if it has none,
+// so a lockout counter can never be left to live forever
+var incrScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// RdxIncr increments a counter and starts its ttl on the first increment
+func RdxIncr(key string, ttl time.Duration) (int64, error) {
+
+	ctx := context.Background()
+
+	n, err := incrScript.Run(ctx, conn, []string{key}, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("error while doing INCR command in redis : %w", err)
+	}
+
+	return n, nil
+}
+
+// RdxTTL returns the remaining time to live of a key, or a negative duration if it has none
+func RdxTTL(key string) (time.Duration, error) {
+
+	ctx := context.Background()
+
+	ttl, err := conn.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("error while doing TTL command in redis : %w", err)
+	}
 
+	return ttl, nil
 }
 
 func RdxGet(key string) (string, error) {
@@ -61,7 +145,7 @@ func RdxGet(key string) (string, error) {
 
 	value, err := conn.Get(ctx, key).Result()
 	if err != nil {
-		return "", fmt.Errorf("error while doing GET command in redis : %v", err)
+		return "", fmt.Errorf("error while doing GET command in redis : %w", err)
 	}
 
 	return value, err
@@ -74,10 +158,10 @@ func RdxDel(key string) (string, error) {
 
 	value, err := conn.Del(ctx, key).Result()
 	if err != nil {
-		return "", fmt.Errorf("error while doing DEL command in redis : %v", err)
+		return "", fmt.Errorf("error while doing DEL command in redis : %w", err)
 	}
 
-	return ""+string(value), err
+	return strconv.FormatInt(value, 10), err
 }
 
 func RdxHset(hash, key, value string) error {
@@ -86,7 +170,7 @@ func RdxHset(hash, key, value string) error {
 
 	_, err := conn.HSet(ctx, hash, key, value).Result()
 	if err != nil {
-		return fmt.Errorf("error while doing HSET command in redis : %v", err)
+		return fmt.Errorf("error while doing HSET command in redis : %w", err)
 	}
 
 	return err
@@ -98,7 +182,7 @@ func RdxHget(hash, key string) (string, error) {
 
 	value, err := conn.HGet(ctx, hash, key).Result()
 	if err != nil {
-		return "error : ", err
+		return "", fmt.Errorf("error while doing HGET command in redis : %w", err)
 	}
 
 	return value, err
@@ -111,10 +195,10 @@ func RdxHdel(hash, key string) (string, error) {
 
 	value, err := conn.HDel(ctx, hash, key).Result()
 	if err != nil {
-		return string(value), fmt.Errorf("error while doing HGET command in redis : %v", err)
+		return strconv.FormatInt(value, 10), fmt.Errorf("error while doing HDEL command in redis : %w", err)
 	}
 
-	return string(value), err
+	return strconv.FormatInt(value, 10), err
 
 }
 
@@ -132,7 +216,7 @@ func RdxAppend(key, value string) error {
 	ctx := context.Background()
 	_, err := conn.Append(ctx, key, value).Result()
 	if err != nil {
-		return fmt.Errorf("error while doing APPEND command in redis : %v", err)
+		return fmt.Errorf("error while doing APPEND command in redis : %w", err)
 	}
 	return err
 }
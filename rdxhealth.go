@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis going away shouldn't take the API with it. Commands have short timeouts, and after a few
+// connection failures in a row Redis is marked degraded: commands then fail at once with
+// errRedisDown instead of each waiting out a timeout, until the monitor's ping gets through again.
+// While degraded, cached reads go to Mongo, and the checks that can't work without Redis follow
+// a policy, "open" to let requests through or "closed" to refuse them:
+//   REDIS_FAIL_RATELIMIT  - rate limits and login lockouts, open by default
+//   REDIS_FAIL_REVOCATION - token revocation checks, open by default
+
+const (
+	failOpen   = "open"
+	failClosed = "closed"
+
+	redisFailuresToDegrade = 3
+	redisProbeInterval     = 5 * time.Second
+	redisProbeTimeout      = time.Second
+)
+
+var errRedisDown = errors.New("redis unavailable")
+
+var (
+	rateLimitFailPolicy  = failOpen
+	revocationFailPolicy = failOpen
+)
+
+type redisHealth struct {
+	degraded atomic.Bool
+	failures atomic.Int32
+	since    atomic.Int64 // unix time of the last change between healthy and degraded
+}
+
+var rdxHealth redisHealth
+
+type redisProbeKey struct{}
+
+func loadRedisPolicies() error {
+	for name, policy := range map[string]*string{
+		"REDIS_FAIL_RATELIMIT":  &rateLimitFailPolicy,
+		"REDIS_FAIL_REVOCATION": &revocationFailPolicy,
+	} {
+		switch value := os.Getenv(name); value {
+		case "":
+		case failOpen, failClosed:
+			*policy = value
+		default:
+			return fmt.Errorf("%s must be %q or %q, not %q", name, failOpen, failClosed, value)
+		}
+	}
+	return nil
+}
+
+func redisDegraded() bool {
+	return rdxHealth.degraded.Load()
+}
+
+func (h *redisHealth) degrade(err error) {
+	if h.degraded.CompareAndSwap(false, true) {
+		h.since.Store(time.Now().Unix())
+		log.Printf("Redis degraded, falling back until it answers again: %v", err)
+	}
+}
+
+// observe feeds the outcome of a command. Replies, including errors Redis itself returns,
+// show the connection works; anything else is a failure.
+func (h *redisHealth) observe(err error) {
+	if err != nil && err != redis.Nil && !errors.Is(err, context.Canceled) {
+		var reply redis.Error
+		if !errors.As(err, &reply) {
+			if h.failures.Add(1) >= redisFailuresToDegrade {
+				h.degrade(err)
+			}
+			return
+		}
+	}
+	h.failures.Store(0)
+	if h.degraded.CompareAndSwap(true, false) {
+		h.since.Store(time.Now().Unix())
+		log.Printf("Redis is back")
+	}
+}
+
+// healthHook short-circuits commands while Redis is degraded and watches the rest
+type healthHook struct{}
+
+func (healthHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (healthHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if redisDegraded() && ctx.Value(redisProbeKey{}) == nil {
+			cmd.SetErr(errRedisDown)
+			return errRedisDown
+		}
+		err := next(ctx, cmd)
+		rdxHealth.observe(err)
+		return err
+	}
+}
+
+func (healthHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if redisDegraded() && ctx.Value(redisProbeKey{}) == nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(errRedisDown)
+			}
+			return errRedisDown
+		}
+		err := next(ctx, cmds)
+		rdxHealth.observe(err)
+		return err
+	}
+}
+
+// startRedisMonitor pings Redis in the background, which is what clears the degraded state
+func startRedisMonitor() {
+	go func() {
+		ticker := time.NewTicker(redisProbeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), redisProbeKey{}, true), redisProbeTimeout)
+			conn.Ping(ctx)
+			cancel()
+		}
+	}()
+}
+
+// redisRetryAfter is what clients refused under a closed policy are told to wait
+func redisRetryAfter() string {
+	return strconv.Itoa(int(redisProbeInterval / time.Second))
+}
+
+// getHealth reports whether the API and its dependencies are up. A degraded Redis still
+// answers 200, the API keeps serving without it.
+func getHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status := http.StatusOK
+	mongoStatus := "ok"
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		mongoStatus = "down"
+		status = http.StatusServiceUnavailable
+	}
+
+	redisStatus := "ok"
+	if redisDegraded() {
+		redisStatus = "degraded"
+	}
+	health := map[string]interface{}{"mongo": mongoStatus, "redis": redisStatus}
+	if since := rdxHealth.since.Load(); since != 0 {
+		health["redis_since"] = since
+	}
+	sendJSONResponse(w, status, health)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func issuedAt(t time.Time) *Claims {
+	return &Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(t)}}
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	useMiniredis(t)
+
+	before := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if err := revokeAllTokens("u1"); err != nil {
+		t.Fatal(err)
+	}
+	// A login right after the revocation, within the same second, like the one after a reset
+	after := time.Now()
+
+	if !isTokenRevoked(issuedAt(before)) {
+		t.Fatal("a token issued before the revocation still works")
+	}
+	if isTokenRevoked(issuedAt(after)) {
+		t.Fatal("a token issued right after the revocation was rejected")
+	}
+	if isTokenRevoked(&Claims{UserID: "u2", RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(before)}}) {
+		t.Fatal("another user's token was revoked")
+	}
+
+	// iat survives the trip through a token, give or take the microsecond lost to the float
+	data, _ := json.Marshal(issuedAt(after))
+	var parsed Claims
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if d := parsed.IssuedAt.Sub(after); d < -2*time.Microsecond || d > 0 || isTokenRevoked(&parsed) {
+		t.Fatalf("iat came back as %v from %s", parsed.IssuedAt.Time, data)
+	}
+}
+
+func TestRevocationInSeconds(t *testing.T) {
+	useMiniredis(t)
+
+	// Entries written before milliseconds cover the whole second they name
+	now := time.Now().Truncate(time.Second)
+	if err := RdxSetEx(revokedUserKey("u1"), strconv.FormatInt(now.Unix(), 10), accessTokenTTL); err != nil {
+		t.Fatal(err)
+	}
+	if !isTokenRevoked(issuedAt(now.Add(999 * time.Millisecond))) {
+		t.Fatal("a token from the revoked second still works")
+	}
+	if isTokenRevoked(issuedAt(now.Add(time.Second))) {
+		t.Fatal("a token from the next second was rejected")
+	}
+}
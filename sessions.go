@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every login creates a session with its own refresh token, so devices don't log each other out.
+// Access tokens carry the session ID in the sid claim.
+
+const (
+	sessionIDKey contextKey = "sessionId"
+
+	maxDeviceLength = 256
+)
+
+func sessionCollection() *mongo.Collection {
+	return client.Database("eventdb").Collection("sessions")
+}
+
+func revokedSessionKey(sessionID string) string {
+	return "revoked:session:" + sessionID
+}
+
+// newSession stores a session for the request's device and returns it with the plain refresh token
+func newSession(userID string, r *http.Request) (Session, string, error) {
+	refreshToken, err := generateSecureToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	sessionID, err := generateTokenID()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	device := r.UserAgent()
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+
+	now := time.Now()
+	session := Session{
+		SessionID:     sessionID,
+		UserID:        userID,
+		Device:        device,
+		IP:            clientIP(r),
+		CreatedAt:     now,
+		LastSeen:      now,
+		RefreshToken:  hashToken(refreshToken),
+		RefreshExpiry: now.Add(refreshTokenTTL),
+	}
+	if _, err := sessionCollection().InsertOne(context.TODO(), session); err != nil {
+		return Session{}, "", err
+	}
+	return session, refreshToken, nil
+}
+
+// revokeSession deletes the session and rejects the access tokens already issued for it
+func revokeSession(sessionID string) error {
+	if _, err := sessionCollection().DeleteOne(context.TODO(), bson.M{"sessionid": sessionID}); err != nil {
+		return err
+	}
+	return RdxSetEx(revokedSessionKey(sessionID), "1", accessTokenTTL)
+}
+
+// revokeOtherSessions signs the user out of every session except keep
+func revokeOtherSessions(userID, keep string) (int, error) {
+	cursor, err := sessionCollection().Find(context.TODO(), bson.M{"userid": userID, "sessionid": bson.M{"$ne": keep}})
+	if err != nil {
+		return 0, err
+	}
+	var sessions []Session
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		return 0, err
+	}
+
+	for _, session := range sessions {
+		if err := revokeSession(session.SessionID); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// getSessions lists the active sessions of the logged in user, newest activity first
+func getSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(sessionIDKey).(string)
+
+	opts := options.Find().SetSort(bson.D{{Key: "last_seen", Value: -1}})
+	cursor, err := sessionCollection().Find(context.TODO(), bson.M{"userid": userID, "refresh_expiry": bson.M{"$gt": time.Now()}}, opts)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	sessions := []Session{}
+	if err := cursor.All(context.TODO(), &sessions); err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SessionID == currentID
+	}
+
+	sendJSONResponse(w, http.StatusOK, sessions)
+}
+
+// deleteSession signs out one of the user's own sessions
+func deleteSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID := ps.ByName("id")
+	err := sessionCollection().FindOne(context.TODO(), bson.M{"sessionid": sessionID, "userid": userID}).Err()
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeSession(sessionID); err != nil {
+		log.Printf("Error revoking session %s: %v", sessionID, err)
+		http.Error(w, "Failed to sign out session", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, nil, "Session signed out", nil)
+}
+
+// logoutOtherSessions signs out everywhere except the session making the request
+func logoutOtherSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value(sessionIDKey).(string)
+	if currentID == "" {
+		http.Error(w, "Token is not bound to a session, please log in again", http.StatusBadRequest)
+		return
+	}
+
+	count, err := revokeOtherSessions(userID, currentID)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %s: %v", userID, err)
+		http.Error(w, "Failed to sign out other sessions", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, map[string]int{"revoked": count}, "Signed out of all other sessions", nil)
+}
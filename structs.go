@@ -35,6 +35,97 @@ type User struct {
 	PasswordHash   string               `json:"password_hash" bson:"password_hash"`
 	Banner         string               `json:"banner,omitempty" bson:"banner,omitempty"`
 	Following      []primitive.ObjectID `json:"following" bson:"following"`
+
+	VerifyToken       string    `json:"-" bson:"verify_token,omitempty"`
+	VerifyExpiry      time.Time `json:"-" bson:"verify_expiry,omitempty"`
+	ResetToken        string    `json:"-" bson:"reset_token,omitempty"`
+	ResetExpiry       time.Time `json:"-" bson:"reset_expiry,omitempty"`
+	TOTPEnabled       bool      `json:"totp_enabled" bson:"totp_enabled"`
+	TOTPSecret        string    `json:"-" bson:"totp_secret,omitempty"`
+	TOTPPendingSecret string    `json:"-" bson:"totp_pending_secret,omitempty"`
+	TOTPLastStep      int64     `json:"-" bson:"totp_last_step,omitempty"`
+	RecoveryCodes     []string  `json:"-" bson:"recovery_codes,omitempty"`
+
+	OIDCIdentities []OIDCIdentity `json:"-" bson:"oidc_identities,omitempty"`
+}
+
+// Session is one signed in device, see sessions.go
+type Session struct {
+	SessionID         string    `json:"id" bson:"sessionid"`
+	UserID            string    `json:"-" bson:"userid"`
+	Device            string    `json:"device" bson:"device"`
+	IP                string    `json:"ip" bson:"ip"`
+	CreatedAt         time.Time `json:"created_at" bson:"created_at"`
+	LastSeen          time.Time `json:"last_seen" bson:"last_seen"`
+	RefreshToken      string    `json:"-" bson:"refresh_token"`
+	RefreshExpiry     time.Time `json:"expires_at" bson:"refresh_expiry"`
+	PrevRefreshTokens []string  `json:"-" bson:"prev_refresh_tokens,omitempty"`
+	Current           bool      `json:"current" bson:"-"`
+}
+
+// AccessToken is a personal access token, see pat.go
+type AccessToken struct {
+	TokenID   string    `json:"id" bson:"tokenid"`
+	UserID    string    `json:"-" bson:"userid"`
+	Name      string    `json:"name" bson:"name"`
+	Scopes    []string  `json:"scopes" bson:"scopes"`
+	TokenHash string    `json:"-" bson:"token_hash"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	LastUsed  time.Time `json:"last_used,omitempty" bson:"last_used,omitempty"`
+}
+
+// DeletionJob is a scheduled account erasure
+type DeletionJob struct {
+	JobID        string         `json:"id" bson:"jobid"`
+	UserID       string         `json:"userid" bson:"userid"`
+	Username     string         `json:"username" bson:"username"`
+	Status       string         `json:"status" bson:"status"`
+	RequestedAt  time.Time      `json:"requested_at" bson:"requested_at"`
+	ScheduledFor time.Time      `json:"scheduled_for" bson:"scheduled_for"`
+	StartedAt    time.Time      `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	FinishedAt   time.Time      `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	Report       DeletionReport `json:"report,omitempty" bson:"report,omitempty"`
+}
+
+// DeletionReport records what an erasure removed or anonymized
+type DeletionReport struct {
+	Removed    map[string]int64 `json:"removed" bson:"removed"`
+	Anonymized []string         `json:"anonymized" bson:"anonymized"`
+	Files      int              `json:"files" bson:"files"`
+	Errors     []string         `json:"errors,omitempty" bson:"errors,omitempty"`
+}
+
+// ExportJob is a personal data archive being built or ready for download
+type ExportJob struct {
+	ExportID    string    `json:"id" bson:"exportid"`
+	UserID      string    `json:"-" bson:"userid"`
+	Status      string    `json:"status" bson:"status"`
+	RequestedAt time.Time `json:"requested_at" bson:"requested_at"`
+	FinishedAt  time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Size        int64     `json:"size,omitempty" bson:"size,omitempty"`
+	Error       string    `json:"error,omitempty" bson:"error,omitempty"`
+	Path        string    `json:"-" bson:"path,omitempty"`
+	TokenHashes []string  `json:"-" bson:"token_hashes,omitempty"` // live download links, newest last
+}
+
+// Purchase records a ticket or merch sale to a user
+type Purchase struct {
+	UserID      string    `json:"-" bson:"userid"`
+	Kind        string    `json:"kind" bson:"kind"` // "ticket" or "merch"
+	EventID     string    `json:"eventid" bson:"eventid"`
+	ItemID      string    `json:"itemid" bson:"itemid"`
+	Name        string    `json:"name" bson:"name"`
+	Quantity    int       `json:"quantity" bson:"quantity"`
+	Price       float64   `json:"price" bson:"price"`
+	PurchasedAt time.Time `json:"purchased_at" bson:"purchased_at"`
+}
+
+// OIDCIdentity links an account to a subject at an external OpenID Connect provider
+type OIDCIdentity struct {
+	Provider string `bson:"provider"`
+	Subject  string `bson:"subject"`
 }
 
 // UserProfileResponse defines the structure for the user profile response
@@ -442,6 +533,7 @@ type Suggestion struct {
 	Title       string             `json:"title" bson:"title"`
 	Description string             `json:"description,omitempty" bson:"description,omitempty"`
 	Name        string             `json:"name"`
+	PlaceID     string             `json:"placeid,omitempty" bson:"placeid,omitempty"`
 }
 
 type Seat struct {
@@ -470,6 +562,7 @@ type Business struct {
 	Type        string             `json:"type" bson:"type"`
 	Location    string             `json:"location" bson:"location"`
 	Description string             `json:"description" bson:"description"`
+	Owners      []string           `json:"owners,omitempty" bson:"owners,omitempty"` // user IDs of the owner accounts
 }
 
 type Booking struct {
@@ -492,11 +585,3 @@ type Promotion struct {
 	Description string             `json:"description" bson:"description"`
 	ExpiryDate  time.Time          `json:"expiry_date" bson:"expiry_date"`
 }
-
-// Owner Management Handlers
-type Owner struct {
-	ID       primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	Name     string             `json:"name" bson:"name"`
-	Email    string             `json:"email" bson:"email"`
-	Password string             `json:"password" bson:"password"`
-}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 
@@ -109,6 +108,7 @@ func createTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		http.Error(w, "Failed to create ticket: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), eventTag(eventID))
 
 	// Respond with the created ticket
 	w.Header().Set("Content-Type", "application/json")
@@ -120,44 +120,16 @@ func createTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 
 func getTickets(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
-	cacheKey := "event:" + eventID + ":tickets"
 
-	// Check if the tickets are cached
-	cachedTickets, err := RdxGet(cacheKey)
-	if err == nil && cachedTickets != "" {
-		// If cached, return the data from Redis
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedTickets))
-		return
-	}
-
-	// Retrieve tickets from MongoDB if not cached
-	collection := client.Database("eventdb").Collection("ticks")
-	var tickList []Ticket
-	filter := bson.M{"eventid": eventID}
-	cursor, err := collection.Find(context.Background(), filter)
+	tickList, err := cached(r.Context(), ticketListCache, eventID, func() ([]Ticket, error) {
+		var tickList []Ticket
+		err := findAll(client.Database("eventdb").Collection("ticks"), bson.M{"eventid": eventID}, &tickList)
+		return tickList, err
+	}, eventTag(eventID))
 	if err != nil {
 		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
-	for cursor.Next(context.Background()) {
-		var tick Ticket
-		if err := cursor.Decode(&tick); err != nil {
-			http.Error(w, "Failed to decode ticket", http.StatusInternalServerError)
-			return
-		}
-		tickList = append(tickList, tick)
-	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
-
-	// Cache the tickets in Redis
-	ticketsJSON, _ := json.Marshal(tickList)
-	RdxSet(cacheKey, string(ticketsJSON))
 
 	// Respond with the ticket data
 	w.Header().Set("Content-Type", "application/json")
@@ -168,29 +140,17 @@ func getTickets(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func getTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	ticketID := ps.ByName("ticketid")
-	cacheKey := fmt.Sprintf("tick:%s:%s", eventID, ticketID)
-
-	// Check if the ticket is cached
-	cachedTicket, err := RdxGet(cacheKey)
-	if err == nil && cachedTicket != "" {
-		// Return cached data
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(cachedTicket))
-		return
-	}
 
-	collection := client.Database("eventdb").Collection("ticks")
-	var ticket Ticket
-	err = collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": ticketID}).Decode(&ticket)
+	ticket, err := cached(r.Context(), ticketCache, eventID+":"+ticketID, func() (Ticket, error) {
+		var ticket Ticket
+		err := client.Database("eventdb").Collection("ticks").FindOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": ticketID}).Decode(&ticket)
+		return ticket, err
+	}, eventTag(eventID))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Ticket not found: %v", err), http.StatusNotFound)
 		return
 	}
 
-	// Cache the result
-	ticketJSON, _ := json.Marshal(ticket)
-	RdxSet(cacheKey, string(ticketJSON))
-
 	// Respond with ticket data
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ticket)
@@ -317,12 +277,7 @@ func editTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Invalidate the cache for the event's tickets
-	if _, err := RdxDel("event:" + eventID + ":tickets"); err != nil {
-		log.Printf("Cache deletion failed for event: %s, Error: %v", eventID, err)
-	} else {
-		log.Printf("Cache invalidated for event: %s", eventID)
-	}
+	invalidate(r.Context(), eventTag(eventID))
 
 	// Respond with success and updated fields
 	w.Header().Set("Content-Type", "application/json")
@@ -346,6 +301,7 @@ func deleteTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), eventTag(eventID))
 	// w.WriteHeader(http.StatusNoContent)
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
@@ -354,7 +310,6 @@ func deleteTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		"success": true,
 		"message": "Ticket deleted successfully",
 	})
-	RdxDel("event:" + eventID + ":tickets") // Invalidate cache after deletion
 }
 
 // Buy Ticket
@@ -403,6 +358,10 @@ func buyTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		http.Error(w, "Failed to update ticket quantity", http.StatusInternalServerError)
 		return
 	}
+	invalidate(r.Context(), eventTag(eventID))
+
+	userID, _ := r.Context().Value(userIDKey).(string)
+	recordPurchase(userID, "ticket", eventID, ticketID, ticket.Name, ticket.Price, quantityRequested)
 
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,41 @@
+// Command mockoidc is a minimal OpenID Connect issuer for trying the social login flow locally.
+// It approves every authorization request as the configured user.
+//
+//	go run ./tools/mockoidc -addr :9000 -email alice@example.com
+//
+// and point the API at it with OIDC_PROVIDERS=mock, OIDC_MOCK_ISSUER=http://localhost:9000,
+// OIDC_MOCK_CLIENT_ID=naevis and OIDC_MOCK_REDIRECT_URL=http://localhost:4000/api/auth/oidc/mock/callback.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"naevis/tools/mockoidc/oidcmock"
+)
+
+var (
+	addr          = flag.String("addr", ":9000", "listen address")
+	issuer        = flag.String("issuer", "http://localhost:9000", "issuer URL as seen by the API")
+	subject       = flag.String("sub", "mock-user-1", "subject of the logged in user")
+	email         = flag.String("email", "alice@example.com", "email of the logged in user")
+	emailVerified = flag.Bool("email-verified", true, "whether the email is reported as verified")
+	username      = flag.String("username", "alice", "preferred_username of the logged in user")
+)
+
+func main() {
+	flag.Parse()
+
+	iss, err := oidcmock.New(*issuer)
+	if err != nil {
+		log.Fatalf("Error generating key: %v", err)
+	}
+	iss.Subject = *subject
+	iss.Email = *email
+	iss.EmailVerified = *emailVerified
+	iss.Username = *username
+
+	log.Printf("Mock OIDC issuer %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, iss.Handler()))
+}
@@ -0,0 +1,187 @@
+// Package oidcmock is a minimal OpenID Connect issuer that approves every authorization request
+// as one configured user. It backs the mockoidc command and the API's OIDC tests.
+package oidcmock
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer holds the user every login is approved as. Set the fields before serving requests.
+type Issuer struct {
+	URL           string // issuer URL as seen by the client
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+
+	// Audience and TokenIssuer replace aud and iss in ID tokens when set, to test clients against bad tokens
+	Audience    string
+	TokenIssuer string
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+type authCode struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	Challenge     string
+	ChallengeMode string
+}
+
+// New returns an issuer with a fresh signing key
+func New(issuerURL string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		URL:           issuerURL,
+		Subject:       "mock-user-1",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Username:      "alice",
+		key:           key,
+		codes:         map[string]authCode{},
+	}, nil
+}
+
+func (i *Issuer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize skips the login page and redirects straight back with a code
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("response_type") != "code" || q.Get("client_id") == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+
+	i.mu.Lock()
+	i.codes[code] = authCode{
+		ClientID:      q.Get("client_id"),
+		RedirectURI:   q.Get("redirect_uri"),
+		Nonce:         q.Get("nonce"),
+		Challenge:     q.Get("code_challenge"),
+		ChallengeMode: q.Get("code_challenge_method"),
+	}
+	i.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	i.mu.Lock()
+	c, ok := i.codes[r.Form.Get("code")]
+	delete(i.codes, r.Form.Get("code"))
+	i.mu.Unlock()
+	if !ok || c.ClientID != r.Form.Get("client_id") || c.RedirectURI != r.Form.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if c.ChallengeMode != "S256" || base64.RawURLEncoding.EncodeToString(sum[:]) != c.Challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	iss, aud := i.URL, c.ClientID
+	if i.TokenIssuer != "" {
+		iss = i.TokenIssuer
+	}
+	if i.Audience != "" {
+		aud = i.Audience
+	}
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":                iss,
+		"sub":                i.Subject,
+		"aud":                aud,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              c.Nonce,
+		"email":              i.Email,
+		"email_verified":     i.EmailVerified,
+		"preferred_username": i.Username,
+	})
+	idToken.Header["kid"] = "mock"
+	signed, err := idToken.SignedString(i.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
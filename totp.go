@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RFC 6238 parameters, the defaults every authenticator app understands
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // accepted steps before/after the current one
+
+	recoveryCodeCount = 10
+
+	challengeTTL         = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+// totpCode computes the code for a time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// validateTOTP returns the matched time step, refusing steps at or before lastStep so a code can't be replayed
+func validateTOTP(encodedSecret, code string, lastStep int64) (int64, bool) {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encodedSecret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// generateRecoveryCodes returns the plain codes for the user and their hashes for storage
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// enrollTOTP starts enrolment and returns the otpauth URI for the authenticator app
+func enrollTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": userID}, bson.M{"$set": bson.M{"totp_pending_secret": secret}})
+	if err != nil {
+		http.Error(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "naevis"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	uri := "otpauth://totp/" + url.PathEscape(issuer+":"+user.Username) + "?" + params.Encode()
+
+	sendResponse(w, http.StatusOK, map[string]string{"otpauthUri": uri, "secret": secret}, "Scan the code and confirm it with a first code", nil)
+}
+
+// confirmTOTP enables 2FA once the user proves the app works and hands out the recovery codes
+func confirmTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "Missing code", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		http.Error(w, "No enrolment in progress", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := validateTOTP(user.TOTPPendingSecret, body.Code, 0)
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": userID}, bson.M{
+		"$set": bson.M{
+			"totp_secret":    user.TOTPPendingSecret,
+			"totp_enabled":   true,
+			"totp_last_step": step,
+			"recovery_codes": hashes,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	})
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	invalidate(r.Context(), userTag(userID))
+
+	sendResponse(w, http.StatusOK, map[string][]string{"recoveryCodes": codes}, "Two-factor authentication enabled", nil)
+}
+
+// disableTOTP turns 2FA off, which needs a current code or a recovery code
+func disableTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		http.Error(w, "Missing code", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if !checkSecondFactor(user, body.Code) {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err := userCollection.UpdateOne(context.TODO(), bson.M{"userid": userID}, bson.M{
+		"$set":   bson.M{"totp_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	})
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	invalidate(r.Context(), userTag(userID))
+
+	sendResponse(w, http.StatusOK, nil, "Two-factor authentication disabled", nil)
+}
+
+// checkSecondFactor accepts a TOTP code or consumes a recovery code
+func checkSecondFactor(user User, code string) bool {
+	code = strings.TrimSpace(code)
+
+	if step, valid := validateTOTP(user.TOTPSecret, code, user.TOTPLastStep); valid {
+		// Only advance the step if nobody else used a newer one in the meantime
+		result, err := userCollection.UpdateOne(
+			context.TODO(),
+			bson.M{"userid": user.UserID, "totp_last_step": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"totp_last_step": step}},
+		)
+		return err == nil && result.ModifiedCount == 1
+	}
+
+	// $pull only succeeds once per code, which keeps recovery codes single-use
+	result, err := userCollection.UpdateOne(
+		context.TODO(),
+		bson.M{"userid": user.UserID, "recovery_codes": hashToken(strings.ToLower(code))},
+		bson.M{"$pull": bson.M{"recovery_codes": hashToken(strings.ToLower(code))}},
+	)
+	if err != nil {
+		log.Printf("Error checking recovery code for user %s: %v", user.UserID, err)
+		return false
+	}
+	return result.ModifiedCount == 1
+}
+
+func challengeKey(challenge string) string {
+	return "2fa:challenge:" + hashToken(challenge)
+}
+
+// loginChallenge is what a challenge stands for: the user, and the username or email they
+// signed in with, which wrong codes count against like wrong passwords do
+type loginChallenge struct {
+	UserID     string `json:"userid"`
+	Identifier string `json:"identifier"`
+}
+
+// createLoginChallenge stores a short-lived challenge proving the password step passed
+func createLoginChallenge(userID, identifier string) (string, error) {
+	challenge, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+	stored, _ := json.Marshal(loginChallenge{UserID: userID, Identifier: identifier})
+	if err := RdxSetEx(challengeKey(challenge), string(stored), challengeTTL); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// loginSecondFactor finishes a login started by login for accounts with 2FA
+func loginSecondFactor(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Challenge == "" || body.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	key := challengeKey(body.Challenge)
+	stored, err := RdxGet(key)
+	var challenge loginChallenge
+	if err != nil || json.Unmarshal([]byte(stored), &challenge) != nil || challenge.UserID == "" {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Fresh challenges don't buy fresh guesses, the login lockout covers the second step too
+	ip := clientIP(r)
+	if wait := loginRetryAfter(challenge.Identifier, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+0.5)))
+		http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": challenge.UserID}).Decode(&user); err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkSecondFactor(user, body.Code) {
+		recordLoginFailure(challenge.Identifier, ip)
+		attempts, err := RdxIncr(key+":attempts", challengeTTL)
+		if err != nil || attempts >= maxChallengeAttempts {
+			RdxDel(key)
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	RdxDel(key)
+	clearLoginFailures(challenge.Identifier)
+
+	tokenString, refreshToken, err := issueTokens(user, r)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, map[string]string{"token": tokenString, "refreshToken": refreshToken, "userid": user.UserID}, "Login successful", nil)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const verifyTokenTTL = 24 * time.Hour
+
+// sendVerificationEmail stores a fresh hashed verification token for the user and mails the plain one
+func sendVerificationEmail(user User) error {
+	token, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	_, err = userCollection.UpdateOne(
+		context.TODO(),
+		bson.M{"userid": user.UserID},
+		bson.M{"$set": bson.M{"verify_token": hashToken(token), "verify_expiry": time.Now().Add(verifyTokenTTL)}},
+	)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("APP_BASE_URL") + "/verify?token=" + token
+	body := fmt.Sprintf("Hi %s,\r\n\r\nPlease confirm your email address by opening the link below:\r\n\r\n%s\r\n\r\nThe link expires in 24 hours.\r\n", user.Username, link)
+	return mailer.Send(user.Email, "Confirm your email address", body)
+}
+
+// verifyEmail confirms the address the token was sent to
+func verifyEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	result, err := userCollection.UpdateOne(
+		context.TODO(),
+		bson.M{"verify_token": hashToken(body.Token), "verify_expiry": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$set":   bson.M{"is_verified": true, "updated_at": time.Now()},
+			"$unset": bson.M{"verify_token": "", "verify_expiry": ""},
+		},
+	)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, nil, "Email verified successfully", nil)
+}
+
+// resendVerification mails a new verification link to the logged in user
+func resendVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user User
+	if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.IsVerified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		log.Printf("Error sending verification email to user %s: %v", userID, err)
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, nil, "Verification email sent", nil)
+}
+
+// requireVerified blocks unverified accounts when REQUIRE_VERIFIED_EMAIL is "true".
+// It must run inside authenticate.
+func requireVerified(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if os.Getenv("REQUIRE_VERIFIED_EMAIL") != "true" {
+			next(w, r, ps)
+			return
+		}
+
+		userID, ok := r.Context().Value(userIDKey).(string)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var user User
+		if err := userCollection.FindOne(context.TODO(), bson.M{"userid": userID}).Decode(&user); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !user.IsVerified {
+			http.Error(w, "Please verify your email address first", http.StatusForbidden)
+			return
+		}
+
+		next(w, r, ps)
+	}
+}